@@ -0,0 +1,402 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Constants for the scope of pause and resume requests.
+const (
+	PauseScopeIntake  = "intake"  // Drop new file system events
+	PauseScopeWorkers = "workers" // Leave queued tasks in the queue
+	PauseScopeAll     = "all"
+)
+
+var (
+	adminSocketPath   string // Unix socket the admin API listens on, removed on shutdown
+	intakePaused      atomic.Bool
+	workersPaused     bool
+	workersPausedCond = sync.NewCond(&sync.Mutex{})
+)
+
+// adminStatus is the response of GET /status.
+type adminStatus struct {
+	PID           int                `json:"pid"`
+	UptimeSeconds float64            `json:"uptime_seconds"`
+	IntakePaused  bool               `json:"intake_paused"`
+	WorkersPaused bool               `json:"workers_paused"`
+	Workers       int                `json:"workers"`
+	BusyWorkers   int                `json:"busy_workers"`
+	QueuedTasks   int                `json:"queued_tasks"`
+	Queues        map[string]float64 `json:"queues"`
+	Watches       []watchReadiness   `json:"watches"`
+}
+
+// runningTask describes a task being processed in the response of GET /tasks.
+type runningTask struct {
+	*Task
+	WorkerID       int       `json:"worker_id"`
+	StartedAt      time.Time `json:"started_at"`
+	RunningSeconds float64   `json:"running_seconds"`
+}
+
+// taskList is the response of GET /tasks.
+type taskList struct {
+	Queued  []*Task       `json:"queued"`
+	Running []runningTask `json:"running"`
+}
+
+// adminRequest is the JSON body of the admin API requests that take parameters.
+type adminRequest struct {
+	Scope string    `json:"scope,omitempty"` // Pause and resume: intake, workers or all (the default)
+	Watch string    `json:"watch,omitempty"` // Rescan: only this watch; enqueue: the watch of the file
+	Path  string    `json:"path,omitempty"`  // Enqueue: the file
+	Event EventType `json:"event,omitempty"` // Enqueue: the event to process the file for, create by default
+	Paths []string  `json:"paths,omitempty"` // State forget: the files to forget
+}
+
+// startAdminServer serves the admin API on the admin_socket Unix socket and, with a token,
+// on the admin_listen TCP address. It does nothing if neither is configured.
+func startAdminServer(config *Config) {
+	if config.AdminSocket == "" && config.AdminListen == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, currentStatus(config))
+	})
+	mux.HandleFunc("POST /pause", func(w http.ResponseWriter, r *http.Request) {
+		handlePause(w, r, true)
+	})
+	mux.HandleFunc("POST /resume", func(w http.ResponseWriter, r *http.Request) {
+		handlePause(w, r, false)
+	})
+	mux.HandleFunc("POST /rescan", func(w http.ResponseWriter, r *http.Request) {
+		handleRescan(w, r, config)
+	})
+	mux.HandleFunc("POST /reload", func(w http.ResponseWriter, r *http.Request) {
+		if err := reloadConfig(config); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, fmt.Errorf("error reloading config: %w", err))
+			return
+		}
+		logInfo("Configuration reloaded on request")
+		writeJSON(w, http.StatusOK, map[string]string{"result": "reloaded"})
+	})
+	mux.HandleFunc("GET /tasks", handleListTasks)
+	mux.HandleFunc("POST /tasks", func(w http.ResponseWriter, r *http.Request) {
+		handleEnqueue(w, r, config)
+	})
+	mux.HandleFunc("DELETE /tasks/{id}", func(w http.ResponseWriter, r *http.Request) {
+		state, err := cancelTask(r.PathValue("id"))
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		logInfo("Canceled %s task %s on request", state, r.PathValue("id"))
+		writeJSON(w, http.StatusOK, map[string]string{"result": "canceled", "state": state})
+	})
+	mux.HandleFunc("GET /state", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, stateResult{Entries: stateDB.entries()})
+	})
+	mux.HandleFunc("POST /state/forget", handleStateForget)
+	mux.HandleFunc("POST /state/reset", func(w http.ResponseWriter, r *http.Request) {
+		if stateDB == nil {
+			writeError(w, http.StatusConflict, errors.New("state_path was not set when the instance started"))
+			return
+		}
+		removed, err := stateDB.reset()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Errorf("error saving state file: %w", err))
+			return
+		}
+		logInfo("Removed %d entries from the state store on request", removed)
+		writeJSON(w, http.StatusOK, stateResult{Removed: removed})
+	})
+
+	if config.AdminSocket != "" {
+		listener, err := listenAdminSocket(config.AdminSocket)
+		if err != nil {
+			logFatal("Error starting admin API: %v", err)
+		}
+		adminSocketPath = config.AdminSocket
+		logInfo("Serving admin API on %s", config.AdminSocket)
+		go serveAdmin(listener, mux)
+	}
+
+	if config.AdminListen != "" {
+		listener, err := net.Listen("tcp", config.AdminListen)
+		if err != nil {
+			logFatal("Error starting admin API on %s: %v", config.AdminListen, err)
+		}
+		logInfo("Serving admin API on %s", config.AdminListen)
+		go serveAdmin(listener, requireToken(os.ExpandEnv(config.AdminToken), mux))
+	}
+}
+
+// listenAdminSocket listens on a Unix socket that only the current user can connect to,
+// replacing a socket left behind by a previous run.
+func listenAdminSocket(socketPath string) (net.Listener, error) {
+	if fi, err := os.Lstat(socketPath); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("admin socket %s exists and is not a socket", socketPath)
+		}
+		if conn, err := net.Dial("unix", socketPath); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("admin socket %s is in use by another instance", socketPath)
+		}
+		if err := os.Remove(socketPath); err != nil {
+			return nil, fmt.Errorf("error removing stale admin socket %s: %w", socketPath, err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0755); err != nil {
+		return nil, fmt.Errorf("error creating directory for admin socket %s: %w", socketPath, err)
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("error listening on admin socket %s: %w", socketPath, err)
+	}
+	// Nothing is served before the socket is restricted, so other users never get an answer
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("error restricting access to admin socket %s: %w", socketPath, err)
+	}
+	return listener, nil
+}
+
+// removeAdminSocket removes the Unix socket of the admin API when shutting down.
+func removeAdminSocket() {
+	if adminSocketPath != "" {
+		os.Remove(adminSocketPath)
+	}
+}
+
+// serveAdmin serves the admin API on a listener until it fails.
+func serveAdmin(listener net.Listener, handler http.Handler) {
+	server := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	if err := server.Serve(listener); err != nil {
+		logError("Error serving admin API on %s: %v", listener.Addr(), err)
+	}
+}
+
+// requireToken only passes on requests that carry the token as a bearer token.
+func requireToken(token string, next http.Handler) http.Handler {
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("missing or invalid token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// currentStatus describes the running instance.
+func currentStatus(config *Config) adminStatus {
+	readiness := checkReadiness(config)
+	return adminStatus{
+		PID:           os.Getpid(),
+		UptimeSeconds: time.Since(startTime).Seconds(),
+		IntakePaused:  intakePaused.Load(),
+		WorkersPaused: isWorkersPaused(),
+		Workers:       int(totalWorkers.Load()),
+		BusyWorkers:   busyWorkerCount(),
+		QueuedTasks:   len(queuedTaskList()),
+		Queues:        readiness.Queues,
+		Watches:       readiness.Watches,
+	}
+}
+
+// handlePause pauses or resumes event intake, the workers, or both.
+func handlePause(w http.ResponseWriter, r *http.Request, pause bool) {
+	req, err := decodeAdminRequest(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	switch req.Scope {
+	case PauseScopeIntake:
+		setIntakePaused(pause)
+	case PauseScopeWorkers:
+		setWorkersPaused(pause)
+	case PauseScopeAll, "":
+		setIntakePaused(pause)
+		setWorkersPaused(pause)
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid scope: %s", req.Scope))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"intake_paused": intakePaused.Load(), "workers_paused": isWorkersPaused()})
+}
+
+// handleRescan queues the existing files of every watch, or of a single one, in the background.
+func handleRescan(w http.ResponseWriter, r *http.Request, config *Config) {
+	req, err := decodeAdminRequest(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if req.Watch == "" {
+		logInfo("Rescanning all watches on request")
+		go processExistingFiles(config)
+	} else {
+		watch := findWatchByID(req.Watch, config)
+		if watch == nil {
+			writeError(w, http.StatusNotFound, fmt.Errorf("no watch with id %s", req.Watch))
+			return
+		}
+		logInfo("Rescanning watch %s on request", watch.ID)
+		go processExistingWatchFiles(watch, config)
+	}
+	writeJSON(w, http.StatusAccepted, map[string]string{"result": "rescan started"})
+}
+
+// handleListTasks lists the queued and running tasks.
+func handleListTasks(w http.ResponseWriter, r *http.Request) {
+	list := taskList{Queued: queuedTaskList(), Running: []runningTask{}}
+	for _, active := range activeTaskList() {
+		list.Running = append(list.Running, runningTask{
+			Task:           active.task,
+			WorkerID:       active.workerID,
+			StartedAt:      active.started,
+			RunningSeconds: time.Since(active.started).Seconds(),
+		})
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// handleEnqueue queues a task for a file right away, without debouncing or settling, and
+// even if the file is unchanged since it was last processed.
+func handleEnqueue(w http.ResponseWriter, r *http.Request, config *Config) {
+	req, err := decodeAdminRequest(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Event == "" {
+		req.Event = CreateEvent
+	}
+	if !isValidEventType(req.Event) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unknown event type: %s", req.Event))
+		return
+	}
+
+	absPath, err := filepath.Abs(req.Path)
+	if err != nil || req.Path == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid path: %q", req.Path))
+		return
+	}
+	watch := findWatch(absPath, config)
+	if req.Watch != "" {
+		watch = findWatchByID(req.Watch, config)
+	}
+	if watch == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no watch configured for file %s", absPath))
+		return
+	}
+	if !isWithinRoot(absPath, watch.root) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("%s is not within %s of watch %s", absPath, watch.TargetPath, watch.ID))
+		return
+	}
+	if req.Event != RemoveEvent {
+		if fi, err := os.Stat(absPath); err != nil || !fi.Mode().IsRegular() {
+			writeError(w, http.StatusNotFound, fmt.Errorf("not a file: %s", absPath))
+			return
+		}
+	}
+
+	task := newTask(watch, absPath, req.Event)
+	task.Force = true
+	logInfo("Queuing task on request: %s", task)
+	enqueueTask(task)
+	writeJSON(w, http.StatusAccepted, task)
+}
+
+// handleStateForget removes files from the state store, so that they are processed again
+// with their next event or rescan.
+func handleStateForget(w http.ResponseWriter, r *http.Request) {
+	req, err := decodeAdminRequest(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if stateDB == nil {
+		writeError(w, http.StatusConflict, errors.New("state_path was not set when the instance started"))
+		return
+	}
+	forgotten := stateDB.forget(req.Paths...)
+	logInfo("Forgot %d of %d paths in the state store on request", forgotten, len(req.Paths))
+	writeJSON(w, http.StatusOK, stateResult{Forgotten: forgotten})
+}
+
+// decodeAdminRequest reads the optional JSON body of an admin API request.
+func decodeAdminRequest(r *http.Request) (*adminRequest, error) {
+	var req adminRequest
+	if r.ContentLength == 0 {
+		return &req, nil
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, fmt.Errorf("invalid request body: %w", err)
+	}
+	return &req, nil
+}
+
+// writeError writes an error as a JSON response.
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+// setIntakePaused pauses or resumes handling file system events.
+func setIntakePaused(pause bool) {
+	if intakePaused.Swap(pause) != pause {
+		if pause {
+			logInfo("Event intake paused; new events are dropped until it is resumed")
+		} else {
+			logInfo("Event intake resumed")
+		}
+	}
+}
+
+// setWorkersPaused pauses or resumes the workers. Running tasks are finished first.
+func setWorkersPaused(pause bool) {
+	workersPausedCond.L.Lock()
+	defer workersPausedCond.L.Unlock()
+	if workersPaused == pause {
+		return
+	}
+	workersPaused = pause
+	if pause {
+		logInfo("Workers paused; queued tasks wait until they are resumed")
+	} else {
+		logInfo("Workers resumed")
+		workersPausedCond.Broadcast()
+	}
+}
+
+// isWorkersPaused reports whether the workers are paused.
+func isWorkersPaused() bool {
+	workersPausedCond.L.Lock()
+	defer workersPausedCond.L.Unlock()
+	return workersPaused
+}
+
+// waitWhileWorkersPaused blocks the calling worker while the workers are paused.
+func waitWhileWorkersPaused() {
+	workersPausedCond.L.Lock()
+	defer workersPausedCond.L.Unlock()
+	for workersPaused {
+		workersPausedCond.Wait()
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// adminCall runs an admin API handler on a request with the given JSON body.
+func adminCall(handler func(http.ResponseWriter, *http.Request), method, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(method, "/", strings.NewReader(body)))
+	return rec
+}
+
+func TestHandlePause(t *testing.T) {
+	defer setIntakePaused(false)
+	defer setWorkersPaused(false)
+
+	pause := func(w http.ResponseWriter, r *http.Request) { handlePause(w, r, true) }
+	resume := func(w http.ResponseWriter, r *http.Request) { handlePause(w, r, false) }
+
+	if rec := adminCall(pause, "POST", `{"scope":"intake"}`); rec.Code != http.StatusOK {
+		t.Fatalf("pause intake: status %d", rec.Code)
+	}
+	if !intakePaused.Load() || isWorkersPaused() {
+		t.Error("pausing the intake paused the workers or not the intake")
+	}
+
+	adminCall(pause, "POST", "")
+	if !intakePaused.Load() || !isWorkersPaused() {
+		t.Error("pause without scope does not pause everything")
+	}
+
+	adminCall(resume, "POST", `{"scope":"workers"}`)
+	if !intakePaused.Load() || isWorkersPaused() {
+		t.Error("resuming the workers resumed the intake or not the workers")
+	}
+
+	if rec := adminCall(pause, "POST", `{"scope":"everything"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid scope: status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	if rec := adminCall(pause, "POST", `{"scope":`); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid body: status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestHandleEnqueue(t *testing.T) {
+	taskQueue = make(chan *Task, 10)
+	defer func() { taskQueue = nil }()
+
+	root := t.TempDir()
+	config := &Config{Watches: []Watch{{ID: "docs", TargetPath: root, OnCreateRun: []string{"echo"}}}}
+	if err := normalizeWatches(config); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(root, "a.txt")
+	if err := os.WriteFile(path, []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	outside := filepath.Join(t.TempDir(), "outside.txt")
+	if err := os.WriteFile(outside, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	enqueue := func(w http.ResponseWriter, r *http.Request) { handleEnqueue(w, r, config) }
+
+	rec := adminCall(enqueue, "POST", `{"path":"`+filepath.ToSlash(path)+`"}`)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var queued Task
+	if err := json.Unmarshal(rec.Body.Bytes(), &queued); err != nil {
+		t.Fatal(err)
+	}
+	task := <-taskQueue
+	if task.ID != queued.ID || task.Path != path || task.Event != CreateEvent || task.WatchID != "docs" || !task.Force {
+		t.Errorf("queued %+v", task)
+	}
+
+	// The task shows in the task list until a worker picks it up
+	rec = adminCall(handleListTasks, "GET", "")
+	if !strings.Contains(rec.Body.String(), task.ID) {
+		t.Errorf("GET /tasks does not list %s: %s", task.ID, rec.Body)
+	}
+	if state, err := cancelTask(task.ID); err != nil || state != "queued" {
+		t.Errorf("cancelTask = %q, %v", state, err)
+	}
+	if _, ok := startWork(902, task); ok {
+		t.Error("worker picked up a canceled task")
+	}
+
+	for body, wantStatus := range map[string]int{
+		`{}`: http.StatusBadRequest,
+		`{"path":"` + filepath.ToSlash(path) + `","event":"touch"}`:                         http.StatusBadRequest,
+		`{"path":"` + filepath.ToSlash(filepath.Join(root, "missing")) + `"}`:               http.StatusNotFound,
+		`{"path":"` + filepath.ToSlash(filepath.Join(t.TempDir(), "x")) + `"}`:              http.StatusNotFound,
+		`{"path":"` + filepath.ToSlash(path) + `","watch":"nope"}`:                          http.StatusNotFound,
+		`{"path":"` + filepath.ToSlash(outside) + `","watch":"docs"}`:                       http.StatusBadRequest,
+		`{"path":"` + filepath.ToSlash(filepath.Join(root, "gone")) + `","event":"remove"}`: http.StatusAccepted,
+	} {
+		if rec := adminCall(enqueue, "POST", body); rec.Code != wantStatus {
+			t.Errorf("%s: status %d, want %d", body, rec.Code, wantStatus)
+		}
+	}
+}
+
+func TestRequireToken(t *testing.T) {
+	handler := requireToken("secret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	for header, wantStatus := range map[string]int{
+		"":              http.StatusUnauthorized,
+		"Bearer wrong":  http.StatusUnauthorized,
+		"secret":        http.StatusUnauthorized,
+		"Bearer secret": http.StatusNoContent,
+	} {
+		req := httptest.NewRequest("GET", "/status", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != wantStatus {
+			t.Errorf("Authorization %q: status %d, want %d", header, rec.Code, wantStatus)
+		}
+	}
+}
+
+func TestListenAdminSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes of Unix sockets")
+	}
+	socketPath := filepath.Join(t.TempDir(), "run", "wtd.sock")
+
+	listener, err := listenAdminSocket(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(socketPath); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("socket mode = %v, %v, want 0600", fi.Mode().Perm(), err)
+	}
+	if _, err := listenAdminSocket(socketPath); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("second listener on a socket in use: %v", err)
+	}
+
+	// A socket left behind by a previous run is replaced
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+	listener, err = listenAdminSocket(socketPath)
+	if err != nil {
+		t.Fatalf("stale socket was not replaced: %v", err)
+	}
+	listener.Close()
+
+	notSocket := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(notSocket, nil, 0644)
+	if _, err := listenAdminSocket(notSocket); err == nil {
+		t.Error("listened on a path that is not a socket")
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	pendingBatches      = make(map[string]*pendingBatch) // By watch id, event type and matching rules
+	pendingBatchesMutex sync.Mutex
+)
+
+// BatchOptions make a watch collect the tasks of several files and run its command once
+// for all of them.
+type BatchOptions struct {
+	Size int `yaml:"size,omitempty"` // Files per batch at most (0 = no limit)
+	Wait int `yaml:"wait,omitempty"` // Milliseconds to wait for more files after the first one
+}
+
+// pendingBatch collects the tasks of a batch until it is full or its wait time is over.
+type pendingBatch struct {
+	tasks []*Task
+	timer *time.Timer
+}
+
+// enabled reports whether the watch runs its commands for batches of files.
+func (b *BatchOptions) enabled() bool {
+	return b.Size > 1 || b.Wait > 0
+}
+
+// validate checks the batch settings of a watch.
+func (b *BatchOptions) validate() error {
+	if b.Size < 0 || b.Wait < 0 {
+		return fmt.Errorf("size and wait must not be negative")
+	}
+	if b.Size > 1 && b.Wait == 0 {
+		return fmt.Errorf("wait is required, otherwise an incomplete batch would never run")
+	}
+	return nil
+}
+
+// enqueueOrBatchTask queues a task, or adds it to a batch if the watch uses batches. Files
+// that don't pass the size, age and content type filters of the watch are dropped here,
+// except for files younger than min_age, which are held until they are old enough. Held
+// and batched tasks are written to the journal right away, so they survive a restart.
+func enqueueOrBatchTask(task *Task, config *Config) {
+	watch := findWatchByID(task.WatchID, config)
+	if watch != nil && task.Event != RemoveEvent && !task.Force {
+		reason, wait := watch.FileFilter.check(task.Path)
+		if wait > 0 {
+			holdUntilOldEnough(task, wait, config)
+			return
+		}
+		if reason != "" {
+			logInfo("Skipping filtered file %s: %s", task.Path, reason)
+			metricSkipped.inc(watch.ID, "filtered")
+			journal.recordAck(task) // Journaled while it was held
+			return
+		}
+	}
+	if watch != nil && watch.Batch.enabled() && task.Event != RemoveEvent {
+		addToBatch(task, watch)
+		return
+	}
+	enqueueTask(task)
+}
+
+// addToBatch adds a task to the pending batch of its watch and event type. The batch is
+// queued as a single task once it holds batch.size files or batch.wait has passed. Files
+// matching different rules go to different batches, since they run different commands.
+func addToBatch(task *Task, watch *Watch) {
+	key := fmt.Sprintf("%s/%s/%v", watch.ID, task.Event, matchingRules(task.Path, watch, task.Event))
+
+	pendingBatchesMutex.Lock()
+	defer pendingBatchesMutex.Unlock()
+
+	batch, exists := pendingBatches[key]
+	if !exists {
+		batch = &pendingBatch{}
+		pendingBatches[key] = batch
+		inFlight.Add(1)
+		batch.timer = time.AfterFunc(time.Duration(watch.Batch.Wait)*time.Millisecond, func() {
+			flushBatch(key, batch, watch)
+		})
+	}
+
+	for _, queued := range batch.tasks {
+		if queued.Path == task.Path {
+			logInfo("%s is already in the next %s batch", task.Path, task.Event)
+			journal.recordAck(task)
+			return
+		}
+	}
+	journal.recordEnqueue(task)
+	batch.tasks = append(batch.tasks, task)
+	logInfo("Added %s to the next %s batch, now %d in it", task.Path, task.Event, len(batch.tasks))
+
+	if watch.Batch.Size > 0 && len(batch.tasks) >= watch.Batch.Size {
+		batch.timer.Stop()
+		delete(pendingBatches, key)
+		go queueBatch(batch, watch) // enqueueTask may block on a full queue
+	}
+}
+
+// flushBatch queues a pending batch whose wait time is over, unless it was queued already
+// because it filled up.
+func flushBatch(key string, batch *pendingBatch, watch *Watch) {
+	pendingBatchesMutex.Lock()
+	if pendingBatches[key] != batch {
+		pendingBatchesMutex.Unlock()
+		return
+	}
+	delete(pendingBatches, key)
+	pendingBatchesMutex.Unlock()
+
+	queueBatch(batch, watch)
+}
+
+// queueBatch hands the tasks of a batch to the worker pool as a single task. In the journal,
+// the batch task replaces the tasks of its files.
+func queueBatch(batch *pendingBatch, watch *Watch) {
+	defer inFlight.Add(-1)
+
+	task := newTask(watch, batch.tasks[0].Path, batch.tasks[0].Event)
+	task.Batch = batch.tasks
+	logInfo("Queuing batch: %s", task)
+	journal.recordEnqueue(task)
+	for _, file := range batch.tasks {
+		journal.recordAck(file)
+	}
+	enqueueTask(task)
+}
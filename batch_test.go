@@ -0,0 +1,155 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestBatchOptionsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		batch   BatchOptions
+		enabled bool
+		wantErr bool
+	}{
+		{"disabled", BatchOptions{}, false, false},
+		{"size 1 is no batch", BatchOptions{Size: 1}, false, false},
+		{"wait only", BatchOptions{Wait: 500}, true, false},
+		{"size and wait", BatchOptions{Size: 10, Wait: 500}, true, false},
+		{"size without wait", BatchOptions{Size: 10}, true, true},
+		{"negative size", BatchOptions{Size: -1, Wait: 500}, true, true},
+		{"negative wait", BatchOptions{Wait: -1}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.batch.enabled(); got != tt.enabled {
+				t.Errorf("enabled() = %v, want %v", got, tt.enabled)
+			}
+			if err := tt.batch.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() = %v, want error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// batchPaths returns the file paths of the tasks in a batch task.
+func batchPaths(task *Task) []string {
+	var paths []string
+	for _, member := range task.Batch {
+		paths = append(paths, filepath.Base(member.Path))
+	}
+	return paths
+}
+
+func receiveBatch(t *testing.T, timeout time.Duration) *Task {
+	t.Helper()
+	select {
+	case task := <-taskQueue:
+		return task
+	case <-time.After(timeout):
+		t.Fatal("no batch was queued")
+		return nil
+	}
+}
+
+func TestBatchFlushesWhenFull(t *testing.T) {
+	taskQueue = make(chan *Task, 10)
+	defer func() { taskQueue = nil }()
+
+	root := t.TempDir()
+	watch := &Watch{ID: "full", root: root}
+	watch.Batch = BatchOptions{Size: 3, Wait: 60000}
+	for _, name := range []string{"a", "b", "a", "c"} {
+		addToBatch(newTask(watch, filepath.Join(root, name), CreateEvent), watch)
+	}
+
+	task := receiveBatch(t, 2*time.Second)
+	if got := batchPaths(task); !slices.Equal(got, []string{"a", "b", "c"}) {
+		t.Errorf("batch holds %q, want a, b and c once each", got)
+	}
+	if task.Event != CreateEvent || task.WatchID != "full" {
+		t.Errorf("batch task = %s", task)
+	}
+}
+
+func TestBatchFlushesAfterWait(t *testing.T) {
+	taskQueue = make(chan *Task, 10)
+	defer func() { taskQueue = nil }()
+
+	root := t.TempDir()
+	watch := &Watch{ID: "wait", root: root}
+	watch.Batch = BatchOptions{Size: 10, Wait: 150}
+
+	start := time.Now()
+	addToBatch(newTask(watch, filepath.Join(root, "a"), CreateEvent), watch)
+	addToBatch(newTask(watch, filepath.Join(root, "b"), WriteEvent), watch)
+	addToBatch(newTask(watch, filepath.Join(root, "c"), CreateEvent), watch)
+
+	// Each event type has its own batch
+	batches := map[EventType][]string{}
+	for i := 0; i < 2; i++ {
+		task := receiveBatch(t, 2*time.Second)
+		batches[task.Event] = batchPaths(task)
+	}
+	if waited := time.Since(start); waited < 150*time.Millisecond {
+		t.Errorf("batches were queued after %v, before the wait time", waited)
+	}
+	if !slices.Equal(batches[CreateEvent], []string{"a", "c"}) || !slices.Equal(batches[WriteEvent], []string{"b"}) {
+		t.Errorf("batches = %q", batches)
+	}
+}
+
+func TestBatchGroupsFilesByRule(t *testing.T) {
+	taskQueue = make(chan *Task, 10)
+	defer func() { taskQueue = nil }()
+
+	root := t.TempDir()
+	watch := &Watch{ID: "rules", root: root, Rules: []Rule{
+		{Extensions: []string{".pdf"}, Actions: []Action{{Run: []string{"print"}}}},
+		{Extensions: []string{".csv"}, Actions: []Action{{Run: []string{"import"}}}},
+	}}
+	watch.Batch = BatchOptions{Size: 10, Wait: 100}
+	for _, name := range []string{"a.pdf", "b.csv", "c.pdf"} {
+		addToBatch(newTask(watch, filepath.Join(root, name), CreateEvent), watch)
+	}
+
+	var batches [][]string
+	for i := 0; i < 2; i++ {
+		batches = append(batches, batchPaths(receiveBatch(t, 2*time.Second)))
+	}
+	slices.SortFunc(batches, func(a, b []string) int { return len(b) - len(a) })
+	if !slices.Equal(batches[0], []string{"a.pdf", "c.pdf"}) || !slices.Equal(batches[1], []string{"b.csv"}) {
+		t.Errorf("batches = %q, want the pdf and csv files apart", batches)
+	}
+}
+
+func TestWhenAcceptsNarrowsBatches(t *testing.T) {
+	dir := t.TempDir()
+	var files []*Task
+	for name, size := range map[string]int{"small.txt": 1, "large.txt": 100} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, &Task{Path: path, Event: CreateEvent})
+	}
+	batch := &Task{ID: "batch", Path: files[0].Path, Event: CreateEvent, Batch: files}
+
+	run, accepted := whenAccepts(&Action{When: &FileFilter{MinSize: 10}}, batch, files)
+	if run == nil || len(accepted) != 1 || filepath.Base(accepted[0].Path) != "large.txt" {
+		t.Fatalf("accepted %v, want only large.txt", accepted)
+	}
+	if run == batch || len(run.Batch) != 1 || run.Path != accepted[0].Path || len(batch.Batch) != 2 {
+		t.Errorf("narrowed batch %+v from %+v", run, batch)
+	}
+
+	if run, _ := whenAccepts(&Action{When: &FileFilter{MinSize: 1000}}, batch, files); run != nil {
+		t.Errorf("action ran for %s although no file passes its when", run)
+	}
+	if run, accepted := whenAccepts(&Action{When: &FileFilter{MaxSize: 1000}}, batch, files); run != batch || len(accepted) != 2 {
+		t.Error("batch whose files all pass was not run as is")
+	}
+}
@@ -2,39 +2,161 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"sync"
+	"time"
 )
 
-// executeCommand executes a given command with its arguments.
-func executeCommand(command []string, filePath string) error {
-	executablePath, args := prepareCommandArgs(command, filePath)
+// commandOptions holds the settings for a single command run.
+type commandOptions struct {
+	Timeout   time.Duration // 0 = no limit
+	KillGrace time.Duration // Time between SIGTERM and SIGKILL when the timeout expires
+	Task      *Task         // Task the command runs for, used by placeholders and WTD_* variables
+	Watch     *Watch        // Watch of the task, used by placeholders and WTD_* variables
+	Env       []string      // Extra KEY=value environment variables
+	DryRun    bool          // Only log the command
+
+	HashAlgorithm string // Used by the {hash} placeholder
+	HashMaxSize   int64
+}
+
+// Constants for the reasons a command can fail.
+const (
+	FailureReasonExit    = "exit"    // The command exited with a non-zero code or could not be run
+	FailureReasonTimeout = "timeout" // The command was killed because it ran longer than its timeout
+)
+
+// executeCommandWithOptions executes a given command with its arguments, killing its whole
+// process group if it runs longer than the timeout in opts.
+func executeCommandWithOptions(ctx context.Context, command []string, filePath string, opts commandOptions) error {
+	values := &placeholderValues{
+		filePath:      filePath,
+		task:          opts.Task,
+		watch:         opts.Watch,
+		hashAlgorithm: opts.HashAlgorithm,
+		hashMaxSize:   opts.HashMaxSize,
+	}
+	defer values.cleanup()
+
+	executablePath, args, err := prepareCommandArgs(command, values)
+	if err != nil {
+		return err
+	}
 
 	if executablePath == "" {
-		logger.Println("Skipping execution of empty command.")
+		logInfo("Skipping execution of empty command.")
+		return nil
+	}
+
+	if opts.DryRun {
+		logInfo("Dry run, not executing: %s %q", executablePath, args)
 		return nil
 	}
 
-	cmd := exec.Command(executablePath, args...)
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, executablePath, args...)
 
 	if filePath != "" {
 		cmd.Dir = filepath.Dir(filePath)
 	}
+	cmd.Env = append(append(os.Environ(), opts.Env...), eventEnv(filePath, opts.Task, opts.Watch)...)
+
+	// Run the command in its own process group so that children it spawns are stopped with it
+	setProcessGroup(cmd)
+	done := make(chan struct{})
+	defer close(done)
+	cmd.Cancel = func() error {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			logError("Command %s timed out after %v. Terminating its process group.", executablePath, opts.Timeout)
+		} else {
+			logInfo("Command %s was canceled. Terminating its process group.", executablePath)
+		}
+		go func() {
+			select {
+			case <-time.After(opts.KillGrace):
+				logError("Command %s did not stop within %v. Killing its process group.", executablePath, opts.KillGrace)
+				killProcessGroup(cmd)
+			case <-done:
+			}
+		}()
+		return terminateProcessGroup(cmd)
+	}
+
+	// Don't let a child that keeps stdout or stderr open hold up Wait forever
+	cmd.WaitDelay = opts.KillGrace
+
+	err = executeCmdAndWait(cmd)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		var cmdErr *CommandError
+		if errors.As(err, &cmdErr) {
+			cmdErr.Reason = FailureReasonTimeout
+			cmdErr.Err = fmt.Errorf("command timed out after %v: %w", opts.Timeout, cmdErr.Err)
+		}
+	}
+	return err
+}
+
+// eventEnv returns the WTD_* variables that describe the event a command runs for.
+func eventEnv(filePath string, task *Task, watch *Watch) []string {
+	if task == nil {
+		return nil
+	}
 
-	return executeCmdAndWait(cmd)
+	env := []string{
+		"WTD_PATH=" + filePath,
+		"WTD_EVENT=" + string(task.Event),
+		"WTD_OLD_PATH=" + task.OldPath,
+		"WTD_TASK_ID=" + task.ID,
+		"WTD_ATTEMPT=" + strconv.Itoa(task.Attempt),
+		"WTD_WORKER_ID=" + strconv.Itoa(task.WorkerID),
+		"WTD_TIMESTAMP=" + task.Timestamp.Format(time.RFC3339),
+	}
+	if watch != nil {
+		env = append(env,
+			"WTD_WATCH_ID="+watch.ID,
+			"WTD_WATCH_ROOT="+watch.root,
+			"WTD_REL_PATH="+filepath.FromSlash(relativeToRoot(filePath, watch)),
+		)
+	}
+	return env
+}
+
+// expandEnv turns a configured env: map into KEY=value pairs, expanding ${VAR}
+// references from the environment of WatchThatDir itself.
+func expandEnv(vars map[string]string) []string {
+	keys := make([]string, 0, len(vars))
+	for key := range vars {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	env := make([]string, 0, len(vars))
+	for _, key := range keys {
+		env = append(env, key+"="+os.ExpandEnv(vars[key]))
+	}
+	return env
 }
 
 // prepareCommandArgs prepares the command arguments, replacing placeholders and resolving executable path.
-func prepareCommandArgs(command []string, filePath string) (string, []string) {
+func prepareCommandArgs(command []string, values *placeholderValues) (string, []string, error) {
 	if len(command) == 0 {
 		// Return empty strings if the command is empty
-		return "", []string{}
+		return "", []string{}, nil
 	}
-	
+
 	executablePath := command[0]
 
 	// Resolve executable path if not absolute
@@ -44,20 +166,24 @@ func prepareCommandArgs(command []string, filePath string) (string, []string) {
 		}
 	}
 
-	// Replace placeholder with actual file path and event type
+	// Replace placeholders with the values of the file and event
 	args := make([]string, 0, len(command)-1)
 	for i, arg := range command {
 		if i == 0 {
 			continue // Skip the executable itself
 		}
-		if arg == "{filepath}" {
-			args = append(args, filePath)
-		} else {
-			args = append(args, arg)
+		if arg == "{filepaths}" {
+			args = append(args, values.filePaths()...) // One argument per file
+			continue
+		}
+		expanded, err := expandPlaceholders(arg, values)
+		if err != nil {
+			return "", nil, err
 		}
+		args = append(args, expanded)
 	}
 
-	return executablePath, args
+	return executablePath, args, nil
 }
 
 // resolveExecutablePath finds the absolute path of an executable.
@@ -81,42 +207,93 @@ func resolveExecutablePath(executableName string) (string, error) {
 }
 
 // executeCmdAndWait executes a command and waits for it to complete, capturing stdout and stderr.
+// The output is copied by cmd itself, so that cmd.WaitDelay also bounds the wait for pipes
+// that processes started by the command keep open.
 func executeCmdAndWait(cmd *exec.Cmd) error {
-	stdoutPipe, err := cmd.StdoutPipe()
-	if err != nil {
-		return fmt.Errorf("error creating stdout pipe: %w", err)
-	}
-	stderrPipe, err := cmd.StderrPipe()
-	if err != nil {
-		return fmt.Errorf("error creating stderr pipe: %w", err)
-	}
-
-	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("error starting command: %w", err)
-	}
+	stdoutReader, stdoutWriter := io.Pipe()
+	stderrReader, stderrWriter := io.Pipe()
+	cmd.Stdout, cmd.Stderr = stdoutWriter, stderrWriter
 
 	var stdoutWg sync.WaitGroup
+	var stderrTail []string
 	stdoutWg.Add(2)
-	go logCmdOutput(stdoutPipe, &stdoutWg, false) // isErrorStream = false
-	go logCmdOutput(stderrPipe, &stdoutWg, true)  // isErrorStream = true
+	go logCmdOutput(stdoutReader, &stdoutWg, false, nil)        // isErrorStream = false
+	go logCmdOutput(stderrReader, &stdoutWg, true, &stderrTail) // isErrorStream = true
 
-	if err := cmd.Wait(); err != nil {
-		return fmt.Errorf("error waiting for command to complete: %w", err)
+	err := cmd.Start()
+	if err == nil {
+		err = cmd.Wait()
 	}
-
+	// All output has been copied once Wait returns; let the loggers finish
+	stdoutWriter.Close()
+	stderrWriter.Close()
 	stdoutWg.Wait()
+
+	if errors.Is(err, exec.ErrWaitDelay) {
+		logInfo("Command %s exited, but processes it started still hold its output open", cmd.Path)
+		err = nil
+	}
+	if err != nil && cmd.Process == nil {
+		return fmt.Errorf("error starting command: %w", err)
+	}
+	if err != nil {
+		return &CommandError{
+			Reason:     FailureReasonExit,
+			ExitCode:   exitCodeOf(err),
+			StderrTail: stderrTail,
+			Err:        fmt.Errorf("error waiting for command to complete: %w", err),
+		}
+	}
+
 	return nil
 }
 
 // logCmdOutput scans and logs the output from a command (stdout or stderr).
-func logCmdOutput(pipe io.ReadCloser, wg *sync.WaitGroup, isErrorStream bool) {
+// If tail is not nil, the last stderrTailLines lines are kept in it.
+func logCmdOutput(pipe io.ReadCloser, wg *sync.WaitGroup, isErrorStream bool, tail *[]string) {
 	defer wg.Done()
 	scanner := bufio.NewScanner(pipe)
 	for scanner.Scan() {
 		if isErrorStream {
-			logger.Printf("Stderr: %s", scanner.Text())
+			logInfo("Stderr: %s", scanner.Text())
 		} else {
-			logger.Printf("Stdout: %s", scanner.Text())
+			logInfo("Stdout: %s", scanner.Text())
 		}
+		if tail != nil {
+			*tail = append(*tail, scanner.Text())
+			if len(*tail) > stderrTailLines {
+				*tail = (*tail)[1:]
+			}
+		}
+	}
+	// Keep the pipe flowing after a line too long for the scanner
+	io.Copy(io.Discard, pipe)
+}
+
+// stderrTailLines is the number of stderr lines kept for failure reports.
+const stderrTailLines = 20
+
+// CommandError describes a command that was started but did not complete successfully.
+type CommandError struct {
+	Reason     string   // FailureReasonExit or FailureReasonTimeout
+	ExitCode   int      // Exit code of the process, -1 if it did not exit normally
+	StderrTail []string // Last lines the command wrote to stderr
+	Err        error
+}
+
+func (e *CommandError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// exitCodeOf returns the exit code carried by an error from cmd.Wait, or -1.
+func exitCodeOf(err error) int {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
 	}
+	return -1
 }
@@ -0,0 +1,101 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestCommandTimeoutKillsProcessGroup(t *testing.T) {
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "file.txt")
+	// The shell ignores SIGTERM and leaves a child behind that holds on to stdout
+	command := []string{"sh", "-c", `trap "" TERM; sleep 30 & echo $! > child; wait`}
+	opts := commandOptions{Timeout: 200 * time.Millisecond, KillGrace: 200 * time.Millisecond}
+
+	start := time.Now()
+	err := executeCommandWithOptions(context.Background(), command, filePath, opts)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("command ran for %v despite its timeout", elapsed)
+	}
+
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) || cmdErr.Reason != FailureReasonTimeout {
+		t.Fatalf("error = %v, want a CommandError with reason timeout", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "child"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for syscall.Kill(pid, 0) == nil {
+		if time.Now().After(deadline) {
+			syscall.Kill(pid, syscall.SIGKILL)
+			t.Fatalf("child process %d survived the timeout", pid)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestCommandDoesNotWaitForChildrenHoldingOutput(t *testing.T) {
+	// The shell exits right away, its background child keeps stdout open
+	command := []string{"sh", "-c", "sleep 30 &"}
+	opts := commandOptions{KillGrace: 200 * time.Millisecond}
+
+	start := time.Now()
+	if err := executeCommandWithOptions(context.Background(), command, "", opts); err != nil {
+		t.Errorf("error = %v, want success", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("waited %v for a child holding the output", elapsed)
+	}
+}
+
+func TestCommandExitReason(t *testing.T) {
+	err := executeCommandWithOptions(context.Background(), []string{"sh", "-c", "exit 4"}, "", commandOptions{Timeout: time.Minute})
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) || cmdErr.Reason != FailureReasonExit || cmdErr.ExitCode != 4 {
+		t.Errorf("error = %v, want a CommandError with reason exit and exit code 4", err)
+	}
+}
+
+func TestCommandEnv(t *testing.T) {
+	t.Setenv("WTD_TEST_HOME", "/home/wtd")
+	root := t.TempDir()
+	filePath := filepath.Join(root, "in", "file.txt")
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	watch := &Watch{ID: "docs", root: root}
+	task := &Task{ID: "t1", Path: filePath, Event: CreateEvent, WatchID: "docs", Attempt: 2}
+	opts := commandOptions{
+		Task:  task,
+		Watch: watch,
+		Env:   expandEnv(map[string]string{"TARGET": "${WTD_TEST_HOME}/out"}),
+	}
+
+	command := []string{"sh", "-c", `echo "$TARGET|$WTD_EVENT|$WTD_WATCH_ID|$WTD_REL_PATH|$WTD_ATTEMPT" > env.out`}
+	if err := executeCommandWithOptions(context.Background(), command, filePath, opts); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(root, "in", "env.out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.TrimSpace(string(data)), "/home/wtd/out|create|docs|in/file.txt|2"; got != want {
+		t.Errorf("command saw %q, want %q", got, want)
+	}
+}
@@ -3,6 +3,9 @@ package main
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
 
 	"gopkg.in/yaml.v3"
 )
@@ -17,6 +20,7 @@ type Config struct {
 	ProcessOnStart    bool     `yaml:"process_on_start"`
 	LogPath           string   `yaml:"logfile_path"`
 	EnableLog         bool     `yaml:"enable_logging"`
+	LogLevel          string   `yaml:"log_level"` // info, error (only errors and failures) or none
 	InitRun           []string `yaml:"init_run"`
 	ExitRun           []string `yaml:"exit_run"`
 	OnCreateRun       []string `yaml:"oncreate_run"`
@@ -24,9 +28,105 @@ type Config struct {
 	OnRenameRun       []string `yaml:"onrename_run"`
 	OnRemoveRun       []string `yaml:"onremove_run"`
 	Debounce          int      `yaml:"debounce"`
+	DebounceMode      string   `yaml:"debounce_mode"`
 	ExcludePaths      []string `yaml:"exclude_path"`
+	IncludePaths      []string `yaml:"include_path"`
 	ReloadConfig      int      `yaml:"reload_config"`
 	CheckInterval     int      `yaml:"check_interval"`
+	CommandTimeout    int      `yaml:"command_timeout"` // Default timeout of file commands in milliseconds (0 = no limit)
+	KillGrace         int      `yaml:"kill_grace"`      // Milliseconds between SIGTERM and SIGKILL when a command times out
+	DryRun            bool     `yaml:"dry_run"`         // Log the commands instead of running them and leave files in place
+	Rules             []Rule   `yaml:"rules,omitempty"`
+	RuleMatch         string   `yaml:"rule_match,omitempty"`
+	Watches           []Watch  `yaml:"watches,omitempty"`
+
+	Env     map[string]string `yaml:"env,omitempty"`      // Extra environment variables for every command, ${VAR} is expanded
+	InitEnv map[string]string `yaml:"init_env,omitempty"` // Added to env for init_run
+	ExitEnv map[string]string `yaml:"exit_env,omitempty"` // Added to env for exit_run
+
+	JournalPath    string `yaml:"journal_path"`    // File recording queued tasks so they survive a restart (empty = disabled)
+	JournalCompact int    `yaml:"journal_compact"` // Rewrite the journal after this many completed tasks
+	StatePath      string `yaml:"state_path"`      // File remembering processed files so unchanged ones are skipped (empty = disabled)
+	StateCompare   string `yaml:"state_compare"`   // metadata (size and mtime) or hash (content)
+
+	SkipIdenticalWrites bool   `yaml:"skip_identical_writes"` // Drop write events that leave a file's content unchanged
+	HashAlgorithm       string `yaml:"hash_algorithm"`        // sha256 or xxhash
+	HashMaxSize         int64  `yaml:"hash_max_size"`         // Files larger than this many bytes are not hashed (0 = no limit)
+
+	IgnoreFile string `yaml:"ignore_file"` // Name of the gitignore-style files honoured in the watched trees (empty = disabled)
+
+	HTTPListen      string `yaml:"http_listen"`       // Address of the HTTP listener serving /metrics, /healthz and /readyz, e.g. 127.0.0.1:9101 (empty = disabled)
+	StallTimeout    int    `yaml:"stall_timeout"`     // Seconds a worker may spend on one task before /healthz fails (0 = no limit)
+	ReadyQueueLimit int    `yaml:"ready_queue_limit"` // /readyz fails while a worker pool has this many queued tasks (0 = no limit)
+
+	AdminSocket string `yaml:"admin_socket"` // Unix socket of the admin API (empty = disabled)
+	AdminListen string `yaml:"admin_listen"` // TCP address of the admin API, requires admin_token (empty = disabled)
+	AdminToken  string `yaml:"admin_token"`  // Bearer token for admin_listen, ${VAR} is expanded
+
+	WatchOptions `yaml:",inline"` // Defaults for the watch built from the top-level settings
+}
+
+// WatchOptions holds the per-watch settings that can also be given at the top level
+// for the default watch.
+type WatchOptions struct {
+	Settle          int  `yaml:"settle,omitempty"`           // Milliseconds a file's size and mtime must stay unchanged before it is queued (0 = disabled)
+	SettleExclusive bool `yaml:"settle_exclusive,omitempty"` // Also wait until the file can be opened exclusively
+	SettleTimeout   int  `yaml:"settle_timeout,omitempty"`   // Milliseconds to wait for a file to settle before giving up (0 = wait forever)
+
+	Retry      RetryPolicy `yaml:"retry,omitempty"`       // Default retry policy of the watch's commands
+	FailedPath string      `yaml:"failed_path,omitempty"` // Directory for files whose command kept failing (empty = leave them in place)
+
+	CaseSensitive *bool `yaml:"case_sensitive,omitempty"` // Case sensitivity of include_path and exclude_path (default: false on Windows and macOS)
+
+	IgnorePresets      []string `yaml:"ignore_presets,omitempty"`        // Named sets of temporary file patterns to exclude, see presets.go
+	TempRenameAsCreate bool     `yaml:"temp_rename_as_create,omitempty"` // Handle renaming an excluded file to an included name as a create event
+
+	FileFilter `yaml:",inline"` // Size, age and content type a file must have to be processed
+
+	Trigger TriggerOptions `yaml:"trigger,omitempty"` // Wait for a marker or manifest before processing a file
+	Batch   BatchOptions   `yaml:"batch,omitempty"`   // Run commands once for a group of files
+
+	PartitionBy string `yaml:"partition_by,omitempty"` // directory, top_folder or "re:<regex>": files with the same key are processed in order
+
+	OnCreateTimeout int `yaml:"oncreate_timeout,omitempty"` // Milliseconds, overrides command_timeout for oncreate_run (0 = use command_timeout)
+	OnModifyTimeout int `yaml:"onmodify_timeout,omitempty"` // Same for onmodify_run
+	OnRenameTimeout int `yaml:"onrename_timeout,omitempty"` // Same for onrename_run
+	OnRemoveTimeout int `yaml:"onremove_timeout,omitempty"` // Same for onremove_run
+
+	OnCreateEnv map[string]string `yaml:"oncreate_env,omitempty"` // Added to the global env for oncreate_run
+	OnModifyEnv map[string]string `yaml:"onmodify_env,omitempty"` // Same for onmodify_run
+	OnRenameEnv map[string]string `yaml:"onrename_env,omitempty"` // Same for onrename_run
+	OnRemoveEnv map[string]string `yaml:"onremove_env,omitempty"` // Same for onremove_run
+}
+
+// Watch defines a single directory tree to monitor together with its own filters,
+// post-processing and commands. When no watches are configured, one is built from
+// the top-level settings.
+type Watch struct {
+	ID                string   `yaml:"id"`
+	TargetPath        string   `yaml:"target_path"`
+	ProcessedPath     string   `yaml:"processed_path"`
+	MaxWorkers        int      `yaml:"max_workers"` // 0 = use the shared worker pool
+	PostProcessAction int      `yaml:"post_process"`
+	FileTypes         []string `yaml:"file_type"`
+	ExcludePaths      []string `yaml:"exclude_path"`
+	IncludePaths      []string `yaml:"include_path"`
+	OnCreateRun       []string `yaml:"oncreate_run"`
+	OnModifyRun       []string `yaml:"onmodify_run"`
+	OnRenameRun       []string `yaml:"onrename_run"`
+	OnRemoveRun       []string `yaml:"onremove_run"`
+	Rules             []Rule   `yaml:"rules"`
+	RuleMatch         string   `yaml:"rule_match"` // first (default) or all
+
+	WatchOptions `yaml:",inline"`
+
+	root     string       // absolute TargetPath, used to route events
+	includes *pathMatcher // compiled IncludePaths, nil if empty
+	excludes *pathMatcher // compiled ExcludePaths, nil if empty
+
+	caseSensitive  bool           // resolved CaseSensitive
+	partitionRe    *regexp.Regexp // compiled PartitionBy regular expression
+	ignoreFileName string         // Config.IgnoreFile
 }
 
 // EventType defines the type for different file system events.
@@ -40,6 +140,12 @@ const (
 	RemoveEvent EventType = "remove"
 )
 
+// Constants for debounce_mode values.
+const (
+	DebounceModeLeading  = "leading"  // Run on the first event, drop the ones that follow within the debounce time
+	DebounceModeTrailing = "trailing" // Run once after the path has been quiet for the debounce time
+)
+
 // Constants for on_completion actions.
 const (
 	PostProcessActionDoNothing = 0
@@ -47,9 +153,9 @@ const (
 	PostProcessActionDelete    = -1
 )
 
-// loadConfig loads the configuration from the specified YAML file, sets default values,
-// and creates a default config file if it doesn't exist.
-func loadConfig(filename string) (*Config, error) {
+// loadConfig loads the configuration from the specified YAML file and sets default values.
+// When the file doesn't exist, the defaults are used, and written to a new file if create is set.
+func loadConfig(filename string, create bool) (*Config, error) {
 	// Default configuration values
 	config := Config{
 		TargetPath:        "targetpath",
@@ -60,6 +166,7 @@ func loadConfig(filename string) (*Config, error) {
 		ProcessOnStart:    true,
 		LogPath:           "FileEventsHandler.log",
 		EnableLog:         false,
+		LogLevel:          LogLevelInfo,
 		InitRun:           nil,
 		ExitRun:           nil,
 		OnCreateRun:       nil,
@@ -67,14 +174,29 @@ func loadConfig(filename string) (*Config, error) {
 		OnRenameRun:       nil,
 		OnRemoveRun:       nil,
 		Debounce:          100,
+		DebounceMode:      DebounceModeLeading,
 		ExcludePaths:      nil,
 		ReloadConfig:      0,
 		CheckInterval:     5,
+		CommandTimeout:    0,
+		KillGrace:         5000,
+		JournalPath:       "",
+		JournalCompact:    1000,
+		StatePath:         "",
+		StateCompare:      StateCompareMetadata,
+		HashAlgorithm:     HashAlgorithmSHA256,
+		HashMaxSize:       100 * 1024 * 1024,
+		IgnoreFile:        ".wtdignore",
+		ReadyQueueLimit:   90,
 	}
 
 	data, err := os.ReadFile(filename)
 	if err != nil {
-		if os.IsNotExist(err) {
+		if !os.IsNotExist(err) {
+			// Error reading config file (other than not existing)
+			return nil, fmt.Errorf("error reading config file: %w", err)
+		}
+		if create {
 			// Config file doesn't exist, create it with default values
 			data, err = yaml.Marshal(&config)
 			if err != nil {
@@ -85,65 +207,221 @@ func loadConfig(filename string) (*Config, error) {
 				return nil, fmt.Errorf("error creating default config file: %w", err)
 			}
 			fmt.Println("Config file not found. Created a new one with default values.")
-			return &config, nil
 		}
-		// Error reading config file (other than not existing)
-		return nil, fmt.Errorf("error reading config file: %w", err)
+	} else {
+		// Unmarshal config file data into the config struct
+		err = yaml.Unmarshal(data, &config)
+		if err != nil {
+			return nil, fmt.Errorf("error unmarshalling config: %w", err)
+		}
 	}
 
-	// Unmarshal config file data into the config struct
-	err = yaml.Unmarshal(data, &config)
-	if err != nil {
-		return nil, fmt.Errorf("error unmarshalling config: %w", err)
+	// Flags and environment variables take precedence over the file
+	if err := applyOverrides(&config); err != nil {
+		return nil, err
+	}
+	if err := validateConfig(&config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// validateConfig checks the settings of a loaded configuration, whether they come from the
+// file, the defaults, flags or environment variables, and normalizes its watches.
+func validateConfig(config *Config) error {
+	// Validate log_level value
+	if config.LogLevel != LogLevelInfo && config.LogLevel != LogLevelError && config.LogLevel != LogLevelNone {
+		return fmt.Errorf("invalid log_level value: %s", config.LogLevel)
 	}
 
 	// Validate post_process value
 	if config.PostProcessAction != PostProcessActionDoNothing &&
 		config.PostProcessAction != PostProcessActionMove &&
 		config.PostProcessAction != PostProcessActionDelete {
-		return nil, fmt.Errorf("invalid post_process value: %d", config.PostProcessAction)
+		return fmt.Errorf("invalid post_process value: %d", config.PostProcessAction)
 	}
 
-	return &config, nil
+	if config.CommandTimeout < 0 || config.KillGrace < 0 {
+		return fmt.Errorf("command_timeout and kill_grace must not be negative")
+	}
+
+	if err := validatePlaceholders(config.InitRun); err != nil {
+		return fmt.Errorf("init_run: %w", err)
+	}
+	if err := validatePlaceholders(config.ExitRun); err != nil {
+		return fmt.Errorf("exit_run: %w", err)
+	}
+
+	// Validate state_compare value
+	if config.StateCompare != StateCompareMetadata && config.StateCompare != StateCompareHash {
+		return fmt.Errorf("invalid state_compare value: %s", config.StateCompare)
+	}
+
+	// Validate hash settings
+	if config.HashAlgorithm != HashAlgorithmSHA256 && config.HashAlgorithm != HashAlgorithmXXHash {
+		return fmt.Errorf("invalid hash_algorithm value: %s", config.HashAlgorithm)
+	}
+	if config.HashMaxSize < 0 {
+		return fmt.Errorf("hash_max_size must not be negative")
+	}
+
+	if config.AdminListen != "" && os.ExpandEnv(config.AdminToken) == "" {
+		return fmt.Errorf("admin_listen requires an admin_token")
+	}
+
+	// Validate debounce_mode value
+	if config.DebounceMode != DebounceModeLeading && config.DebounceMode != DebounceModeTrailing {
+		return fmt.Errorf("invalid debounce_mode value: %s", config.DebounceMode)
+	}
+
+	return normalizeWatches(config)
 }
 
-// loadConfig loads the configuration from the specified YAML file.
-func loadConfig_old(filename string) (*Config, error) {
-	data, err := os.ReadFile(filename)
-	if err != nil {
-		return nil, fmt.Errorf("error reading config file: %w", err)
-	}
-
-	var config Config
-	//Set default value
-	config.CheckInterval = 5
-	config.ReloadConfig = 0
-	config.ExcludePaths = nil
-	config.Debounce = 10
-	config.OnRemoveRun = nil
-	config.OnRenameRun = nil
-	config.OnModifyRun = nil
-	config.OnCreateRun = nil
-	config.InitRun = nil
-	config.ExitRun = nil
-	config.EnableLog = false
-	config.LogPath = "WatchThatDir"
-	config.ProcessOnStart = true
-	config.FileTypes = nil //empty to allow all file types
-	config.PostProcessAction = 0 //do nothing after process the file
-	config.MaxWorkers = 1
-	config.ProcessedPath = "completed"
-	config.TargetPath = "targetpath"
-
-	err = yaml.Unmarshal(data, &config)
+// mergeDefaults fills the fields of dst that are not set with the ones of defaults. Nested
+// structs are merged field by field, so a watch that sets retry.retries keeps the top-level
+// retry.initial.
+func mergeDefaults(dst, defaults reflect.Value) {
+	for i := 0; i < dst.NumField(); i++ {
+		field := dst.Field(i)
+		switch {
+		case field.Kind() == reflect.Struct:
+			mergeDefaults(field, defaults.Field(i))
+		case field.IsZero():
+			field.Set(defaults.Field(i))
+		}
+	}
+}
+
+// normalizeWatches builds the default watch from the top-level settings when no
+// watches are configured, then fills in and validates every watch entry.
+func normalizeWatches(config *Config) error {
+	if len(config.Watches) == 0 {
+		config.Watches = []Watch{{
+			ID:                "default",
+			TargetPath:        config.TargetPath,
+			ProcessedPath:     config.ProcessedPath,
+			PostProcessAction: config.PostProcessAction,
+			FileTypes:         config.FileTypes,
+			ExcludePaths:      config.ExcludePaths,
+			IncludePaths:      config.IncludePaths,
+			OnCreateRun:       config.OnCreateRun,
+			OnModifyRun:       config.OnModifyRun,
+			OnRenameRun:       config.OnRenameRun,
+			OnRemoveRun:       config.OnRemoveRun,
+			Rules:             config.Rules,
+			RuleMatch:         config.RuleMatch,
+			WatchOptions:      config.WatchOptions,
+		}}
+	}
+
+	seen := make(map[string]bool)
+	for i := range config.Watches {
+		watch := &config.Watches[i]
+		if watch.TargetPath == "" {
+			return fmt.Errorf("watch %d: target_path is required", i+1)
+		}
+		if watch.ID == "" {
+			watch.ID = fmt.Sprintf("watch%d", i+1)
+		}
+		if seen[watch.ID] {
+			return fmt.Errorf("duplicate watch id: %s", watch.ID)
+		}
+		seen[watch.ID] = true
+
+		if watch.ProcessedPath == "" {
+			watch.ProcessedPath = config.ProcessedPath
+		}
+		mergeDefaults(reflect.ValueOf(&watch.WatchOptions).Elem(), reflect.ValueOf(config.WatchOptions))
+		if watch.PostProcessAction != PostProcessActionDoNothing &&
+			watch.PostProcessAction != PostProcessActionMove &&
+			watch.PostProcessAction != PostProcessActionDelete {
+			return fmt.Errorf("watch %s: invalid post_process value: %d", watch.ID, watch.PostProcessAction)
+		}
+		for _, eventType := range []EventType{CreateEvent, WriteEvent, RenameEvent, RemoveEvent} {
+			if err := validatePlaceholders(legacyCommand(watch, eventType)); err != nil {
+				return fmt.Errorf("watch %s: %s command: %w", watch.ID, eventType, err)
+			}
+		}
+		if watch.OnCreateTimeout < 0 || watch.OnModifyTimeout < 0 || watch.OnRenameTimeout < 0 || watch.OnRemoveTimeout < 0 {
+			return fmt.Errorf("watch %s: on*_timeout must not be negative", watch.ID)
+		}
+		if err := validateRules(watch); err != nil {
+			return err
+		}
+		if watch.Settle < 0 || watch.SettleTimeout < 0 {
+			return fmt.Errorf("watch %s: settle and settle_timeout must not be negative", watch.ID)
+		}
+		if err := validateRetryPolicy(&watch.Retry); err != nil {
+			return fmt.Errorf("watch %s: retry: %w", watch.ID, err)
+		}
+		if err := watch.FileFilter.validate(); err != nil {
+			return fmt.Errorf("watch %s: %w", watch.ID, err)
+		}
+		if err := watch.Trigger.validate(); err != nil {
+			return fmt.Errorf("watch %s: trigger: %w", watch.ID, err)
+		}
+		if err := watch.Batch.validate(); err != nil {
+			return fmt.Errorf("watch %s: batch: %w", watch.ID, err)
+		}
+		if err := compilePartition(watch); err != nil {
+			return fmt.Errorf("watch %s: %w", watch.ID, err)
+		}
+
+		root, err := filepath.Abs(watch.TargetPath)
+		if err != nil {
+			return fmt.Errorf("watch %s: error getting absolute path for %s: %w", watch.ID, watch.TargetPath, err)
+		}
+		watch.root = root
+
+		watch.caseSensitive = defaultCaseSensitive()
+		if watch.CaseSensitive != nil {
+			watch.caseSensitive = *watch.CaseSensitive
+		}
+		if watch.includes, err = compilePathPatterns(watch.IncludePaths, watch.caseSensitive); err != nil {
+			return fmt.Errorf("watch %s: include_path: %w", watch.ID, err)
+		}
+		// Presets come first so that "!" patterns in exclude_path can include files again
+		excludes, err := presetPatterns(watch.IgnorePresets)
+		if err != nil {
+			return fmt.Errorf("watch %s: ignore_presets: %w", watch.ID, err)
+		}
+		excludes = append(excludes, watch.ExcludePaths...)
+		if watch.excludes, err = compilePathPatterns(excludes, watch.caseSensitive); err != nil {
+			return fmt.Errorf("watch %s: exclude_path: %w", watch.ID, err)
+		}
+		watch.ignoreFileName = config.IgnoreFile
+	}
+
+	return nil
+}
+
+// findWatch returns the watch whose root contains the given path. When roots are
+// nested, the deepest one wins. It returns nil if no watch contains the path.
+func findWatch(path string, config *Config) *Watch {
+	absPath, err := filepath.Abs(path)
 	if err != nil {
-		return nil, fmt.Errorf("error unmarshalling config: %w", err)
+		return nil
 	}
 
-	// Validate on_completion value
-	if config.PostProcessAction != PostProcessActionDoNothing && config.PostProcessAction != PostProcessActionMove && config.PostProcessAction != PostProcessActionDelete {
-		return nil, fmt.Errorf("invalid post_process value: %d", config.PostProcessAction)
+	var found *Watch
+	for i := range config.Watches {
+		watch := &config.Watches[i]
+		if !isWithinRoot(absPath, watch.root) {
+			continue
+		}
+		if found == nil || len(watch.root) > len(found.root) {
+			found = watch
+		}
 	}
+	return found
+}
 
-	return &config, nil
+// findWatchByID returns the watch with the given id, or nil if there is none.
+func findWatchByID(id string, config *Config) *Watch {
+	for i := range config.Watches {
+		if config.Watches[i].ID == id {
+			return &config.Watches[i]
+		}
+	}
+	return nil
 }
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeWatchesDefaultWatch(t *testing.T) {
+	config := &Config{
+		TargetPath:        "in",
+		ProcessedPath:     "done",
+		PostProcessAction: PostProcessActionMove,
+		FileTypes:         []string{".csv"},
+		OnCreateRun:       []string{"echo"},
+	}
+	if err := normalizeWatches(config); err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Watches) != 1 {
+		t.Fatalf("got %d watches, want 1", len(config.Watches))
+	}
+	watch := config.Watches[0]
+	if watch.ID != "default" || watch.TargetPath != "in" || watch.ProcessedPath != "done" {
+		t.Errorf("default watch = %+v", watch)
+	}
+	if watch.PostProcessAction != PostProcessActionMove || len(watch.FileTypes) != 1 || len(watch.OnCreateRun) != 1 {
+		t.Errorf("default watch did not take the top-level settings: %+v", watch)
+	}
+	if want, _ := filepath.Abs("in"); watch.root != want {
+		t.Errorf("root = %s, want %s", watch.root, want)
+	}
+}
+
+func TestNormalizeWatchesExplicit(t *testing.T) {
+	config := &Config{
+		TargetPath:    "ignored",
+		ProcessedPath: "done",
+		Watches: []Watch{
+			{ID: "a", TargetPath: "in/a"},
+			{TargetPath: "in/b", ProcessedPath: "b-done"},
+		},
+	}
+	if err := normalizeWatches(config); err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Watches) != 2 {
+		t.Fatalf("got %d watches, want 2", len(config.Watches))
+	}
+	if config.Watches[0].ProcessedPath != "done" {
+		t.Errorf("watch a processed_path = %q, want the top-level value", config.Watches[0].ProcessedPath)
+	}
+	if config.Watches[1].ID != "watch2" || config.Watches[1].ProcessedPath != "b-done" {
+		t.Errorf("second watch = %+v", config.Watches[1])
+	}
+}
+
+func TestNormalizeWatchesInheritsOptions(t *testing.T) {
+	config := &Config{Watches: []Watch{
+		{ID: "a", TargetPath: "in/a"},
+		{ID: "b", TargetPath: "in/b"},
+	}}
+	config.Settle = 500
+	config.Retry = RetryPolicy{Retries: 3, Initial: 200}
+	config.MinSize = 10
+	config.Batch.Wait = 1000
+	config.OnCreateEnv = map[string]string{"STAGE": "prod"}
+	config.Watches[1].Settle = 50
+	config.Watches[1].Retry.Retries = 1
+	config.Watches[1].MaxSize = 99
+
+	if err := normalizeWatches(config); err != nil {
+		t.Fatal(err)
+	}
+	a, b := config.Watches[0], config.Watches[1]
+	if a.Settle != 500 || a.Retry.Retries != 3 || a.Retry.Initial != 200 || a.MinSize != 10 || a.Batch.Wait != 1000 || a.OnCreateEnv["STAGE"] != "prod" {
+		t.Errorf("watch a did not inherit the top-level options: %+v", a.WatchOptions)
+	}
+	if b.Settle != 50 || b.Retry.Retries != 1 || b.MaxSize != 99 {
+		t.Errorf("watch b lost its own options: %+v", b.WatchOptions)
+	}
+	if b.Retry.Initial != 200 || b.MinSize != 10 {
+		t.Errorf("watch b did not inherit the options it leaves unset: %+v", b.WatchOptions)
+	}
+}
+
+func TestNormalizeWatchesErrors(t *testing.T) {
+	tests := map[string][]Watch{
+		"target_path is required": {{ID: "a"}},
+		"duplicate watch id":      {{ID: "a", TargetPath: "x"}, {ID: "a", TargetPath: "y"}},
+		"invalid post_process":    {{ID: "a", TargetPath: "x", PostProcessAction: 7}},
+	}
+	for want, watches := range tests {
+		err := normalizeWatches(&Config{Watches: watches})
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("normalizeWatches(%+v) error = %v, want %q", watches, err, want)
+		}
+	}
+}
+
+func TestFindWatch(t *testing.T) {
+	root := t.TempDir()
+	config := &Config{Watches: []Watch{
+		{ID: "outer", TargetPath: root},
+		{ID: "inner", TargetPath: filepath.Join(root, "nested")},
+	}}
+	if err := normalizeWatches(config); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := findWatch(filepath.Join(root, "file.txt"), config); w == nil || w.ID != "outer" {
+		t.Errorf("file in outer root routed to %v", w)
+	}
+	if w := findWatch(filepath.Join(root, "nested", "deeper", "file.txt"), config); w == nil || w.ID != "inner" {
+		t.Errorf("file in nested root routed to %v", w)
+	}
+	if w := findWatch(root+"-sibling", config); w != nil {
+		t.Errorf("path next to the root routed to %s", w.ID)
+	}
+}
+
+func TestIsWithinRoot(t *testing.T) {
+	root := filepath.Join(string(filepath.Separator), "data", "in")
+	if !isWithinRoot(root, root) {
+		t.Error("root itself is not within root")
+	}
+	if !isWithinRoot(filepath.Join(root, "a", "b"), root) {
+		t.Error("descendant is not within root")
+	}
+	if isWithinRoot(root+"put", root) {
+		t.Error("sibling sharing a name prefix is within root")
+	}
+	if isWithinRoot(filepath.Dir(root), root) {
+		t.Error("parent is within root")
+	}
+	if isWithinRoot(root, "") {
+		t.Error("empty root contains a path")
+	}
+}
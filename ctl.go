@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// usage describes the subcommands.
+const usage = `Usage: WatchThatDir [flags] [command]
+
+Commands:
+  run                          Watch the configured directories (the default)
+  status                       Show the state of the running instance
+  pause [intake|workers|all]   Stop taking new events, stop the workers, or both
+  resume [intake|workers|all]  Undo pause
+  rescan [--watch id]          Queue the existing files again
+  reload                       Load the configuration file again
+  queue ls                     List queued and running tasks
+  queue cancel <id>            Cancel a queued or running task
+  enqueue <path> [--event create] [--watch id]
+                               Queue a file right away
+  state list|forget|reset      Inspect or clear the processed file state
+
+Commands that talk to the running instance can also be given as "ctl <command>" and
+accept --json to print the raw response. They use admin_socket, or admin_listen with
+admin_token, from the configuration.
+
+Flags (before the command, or after run) override the configuration file, and so do
+the environment variables in brackets; a flag wins over its variable:
+  --config path          Configuration file, default config.yaml (WTD_CONFIG)
+  --target dir           Directory to watch, if the config has no watches: list (WTD_TARGET)
+  --workers n            Workers in the shared pool (WTD_WORKERS)
+  --log-level level      info, error or none (WTD_LOG_LEVEL)
+  --log-file path        Write the log to this file (WTD_LOG_FILE)
+  --once                 Process the existing files, then exit (WTD_ONCE)
+  --dry-run              Log the commands instead of running them (WTD_DRY_RUN)
+  --http-listen addr     Address for /metrics, /healthz and /readyz (WTD_HTTP_LISTEN)
+  --admin-socket path    Unix socket of the admin API (WTD_ADMIN_SOCKET)
+`
+
+// errNoInstance is returned by adminClient.do when nothing listens on the admin API.
+var errNoInstance = errors.New("error connecting to the running instance (is it running?)")
+
+// adminClient sends requests to the admin API of a running instance.
+type adminClient struct {
+	http    *http.Client
+	baseURL string
+	token   string
+}
+
+// runCommand runs a subcommand instead of the watcher and returns the exit code.
+func runCommand(config *Config, args []string) int {
+	switch args[0] {
+	case "state":
+		return runStateCommand(config, args[1:])
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage)
+		return 0
+	case "status", "pause", "resume", "rescan", "reload", "queue", "enqueue":
+		return runCtlCommand(config, args[0], args[1:])
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", args[0], usage)
+	return 2
+}
+
+// runCtlCommand sends a command to the admin API of the running instance and prints the answer.
+func runCtlCommand(config *Config, command string, args []string) int {
+	fs := flag.NewFlagSet(command, flag.ContinueOnError)
+	jsonOutput := fs.Bool("json", false, "print the raw JSON response")
+	watchID := fs.String("watch", "", "only this watch (rescan), or the watch of the file (enqueue)")
+	event := fs.String("event", string(CreateEvent), "event to process the file for (enqueue)")
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return 2
+	}
+
+	client, err := newAdminClient(config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	var method, path string
+	var body *adminRequest
+	switch command {
+	case "status":
+		method, path = http.MethodGet, "/status"
+	case "pause", "resume":
+		scope := PauseScopeAll
+		if len(positional) > 0 {
+			scope = positional[0]
+		}
+		method, path, body = http.MethodPost, "/"+command, &adminRequest{Scope: scope}
+	case "rescan":
+		method, path, body = http.MethodPost, "/rescan", &adminRequest{Watch: *watchID}
+	case "reload":
+		method, path = http.MethodPost, "/reload"
+	case "queue":
+		switch {
+		case len(positional) == 0 || positional[0] == "ls" || positional[0] == "list":
+			method, path = http.MethodGet, "/tasks"
+		case positional[0] == "cancel" && len(positional) == 2:
+			method, path = http.MethodDelete, "/tasks/"+positional[1]
+		default:
+			fmt.Fprint(os.Stderr, "usage: queue ls | queue cancel <id>\n")
+			return 2
+		}
+	case "enqueue":
+		if len(positional) != 1 {
+			fmt.Fprint(os.Stderr, "usage: enqueue <path> [--event create] [--watch id]\n")
+			return 2
+		}
+		absPath, err := filepath.Abs(positional[0])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		method, path = http.MethodPost, "/tasks"
+		body = &adminRequest{Path: absPath, Event: EventType(*event), Watch: *watchID}
+	}
+
+	data, err := client.do(method, path, body)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *jsonOutput {
+		os.Stdout.Write(data)
+		return 0
+	}
+	if err := printCtlResponse(command, positional, data); err != nil {
+		fmt.Fprintln(os.Stderr, "error reading response:", err)
+		return 1
+	}
+	return 0
+}
+
+// parseInterspersed parses flags that may come before, between or after the positional
+// arguments, and returns the positional arguments.
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// newAdminClient creates a client for the admin_socket of the configuration, or for
+// admin_listen if no socket is configured.
+func newAdminClient(config *Config) (*adminClient, error) {
+	switch {
+	case config.AdminSocket != "":
+		socketPath := config.AdminSocket
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socketPath)
+			},
+		}
+		return &adminClient{http: &http.Client{Transport: transport, Timeout: 30 * time.Second}, baseURL: "http://wtd"}, nil
+	case config.AdminListen != "":
+		return &adminClient{
+			http:    &http.Client{Timeout: 30 * time.Second},
+			baseURL: "http://" + config.AdminListen,
+			token:   os.ExpandEnv(config.AdminToken),
+		}, nil
+	}
+	return nil, errors.New("neither admin_socket nor admin_listen is set in the configuration")
+}
+
+// do sends a request with an optional JSON body and returns the response body. Error
+// responses of the admin API are returned as errors.
+func (c *adminClient) do(method, path string, body *adminRequest) ([]byte, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, c.baseURL+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return nil, fmt.Errorf("%w: %v", errNoInstance, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error sending request to the running instance: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response: %w", err)
+	}
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(data, &apiErr) == nil && apiErr.Error != "" {
+			return nil, errors.New(apiErr.Error)
+		}
+		return nil, fmt.Errorf("request failed: %s", resp.Status)
+	}
+	return data, nil
+}
+
+// printCtlResponse prints the response to a command in a human-readable form.
+func printCtlResponse(command string, positional []string, data []byte) error {
+	switch command {
+	case "status":
+		var status adminStatus
+		if err := json.Unmarshal(data, &status); err != nil {
+			return err
+		}
+		printStatus(&status)
+
+	case "pause", "resume":
+		var state struct {
+			IntakePaused  bool `json:"intake_paused"`
+			WorkersPaused bool `json:"workers_paused"`
+		}
+		if err := json.Unmarshal(data, &state); err != nil {
+			return err
+		}
+		fmt.Printf("Intake %s, workers %s\n", pausedState(state.IntakePaused), pausedState(state.WorkersPaused))
+
+	case "rescan":
+		fmt.Println("Rescan started")
+
+	case "reload":
+		fmt.Println("Configuration reloaded")
+
+	case "queue":
+		if len(positional) > 0 && positional[0] == "cancel" {
+			var result struct {
+				State string `json:"state"`
+			}
+			if err := json.Unmarshal(data, &result); err != nil {
+				return err
+			}
+			fmt.Printf("Canceled %s task %s\n", result.State, positional[1])
+			return nil
+		}
+		var list taskList
+		if err := json.Unmarshal(data, &list); err != nil {
+			return err
+		}
+		printTaskList(&list)
+
+	case "enqueue":
+		var task Task
+		if err := json.Unmarshal(data, &task); err != nil {
+			return err
+		}
+		fmt.Printf("Queued %s (%s, task %s)\n", task.Path, task.Event, task.ID)
+	}
+	return nil
+}
+
+// printStatus prints the status of the running instance.
+func printStatus(status *adminStatus) {
+	fmt.Printf("PID:      %d\n", status.PID)
+	fmt.Printf("Uptime:   %v\n", (time.Duration(status.UptimeSeconds) * time.Second).String())
+	fmt.Printf("Intake:   %s\n", pausedState(status.IntakePaused))
+	fmt.Printf("Workers:  %s, %d of %d busy\n", pausedState(status.WorkersPaused), status.BusyWorkers, status.Workers)
+
+	pools := make([]string, 0, len(status.Queues))
+	for pool, depth := range status.Queues {
+		pools = append(pools, fmt.Sprintf("%s %v", pool, depth))
+	}
+	sort.Strings(pools)
+	fmt.Printf("Queued:   %d (%s)\n\n", status.QueuedTasks, strings.Join(pools, ", "))
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "WATCH\tTARGET PATH\tREGISTERED\tACCESSIBLE")
+	for _, watch := range status.Watches {
+		fmt.Fprintf(w, "%s\t%s\t%t\t%t\n", watch.ID, watch.TargetPath, watch.Registered, watch.Accessible)
+	}
+	w.Flush()
+}
+
+// printTaskList prints the running and queued tasks, running ones first.
+func printTaskList(list *taskList) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTATE\tEVENT\tWATCH\tAGE\tPATH")
+	for _, task := range list.Running {
+		state := fmt.Sprintf("worker %d", task.WorkerID)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", task.ID, state, task.Event, task.WatchID, taskAge(task.Timestamp), describeTaskPath(task.Task))
+	}
+	for _, task := range list.Queued {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", task.ID, "queued", task.Event, task.WatchID, taskAge(task.Timestamp), describeTaskPath(task))
+	}
+	w.Flush()
+}
+
+// describeTaskPath returns the file of a task, or its first file and the size of its batch.
+func describeTaskPath(task *Task) string {
+	if len(task.Batch) > 1 {
+		return fmt.Sprintf("%s (+%d more)", task.Path, len(task.Batch)-1)
+	}
+	return task.Path
+}
+
+// taskAge returns how long ago a task was created, rounded to the second.
+func taskAge(created time.Time) string {
+	return time.Since(created).Round(time.Second).String()
+}
+
+// pausedState describes a pause flag.
+func pausedState(paused bool) string {
+	if paused {
+		return "paused"
+	}
+	return "running"
+}
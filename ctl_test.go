@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseInterspersed(t *testing.T) {
+	fs := flag.NewFlagSet("enqueue", flag.ContinueOnError)
+	event := fs.String("event", "create", "")
+	jsonOutput := fs.Bool("json", false, "")
+
+	positional, err := parseInterspersed(fs, []string{"--json", "a.txt", "--event", "write", "b.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(positional, []string{"a.txt", "b.txt"}) || *event != "write" || !*jsonOutput {
+		t.Errorf("positional %q, event %q, json %v", positional, *event, *jsonOutput)
+	}
+}
+
+func TestAdminClientDo(t *testing.T) {
+	server := httptest.NewServer(requireToken("secret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, err := decodeAdminRequest(r)
+		switch {
+		case err != nil:
+			writeError(w, http.StatusBadRequest, err)
+		case req.Scope == "bad":
+			writeError(w, http.StatusBadRequest, errors.New("invalid scope: bad"))
+		case r.URL.Path == "/teapot":
+			w.WriteHeader(http.StatusTeapot)
+		default:
+			writeJSON(w, http.StatusOK, map[string]string{"method": r.Method, "scope": req.Scope})
+		}
+	})))
+	defer server.Close()
+	t.Setenv("WTD_TEST_TOKEN", "secret")
+
+	address := strings.TrimPrefix(server.URL, "http://")
+	client, err := newAdminClient(&Config{AdminListen: address, AdminToken: "${WTD_TEST_TOKEN}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := client.do(http.MethodPost, "/pause", &adminRequest{Scope: "intake"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var echoed map[string]string
+	if err := json.Unmarshal(data, &echoed); err != nil || echoed["method"] != "POST" || echoed["scope"] != "intake" {
+		t.Errorf("do = %s, %v", data, err)
+	}
+	if _, err := client.do(http.MethodPost, "/pause", &adminRequest{Scope: "bad"}); err == nil || err.Error() != "invalid scope: bad" {
+		t.Errorf("API error returned as %v", err)
+	}
+	if _, err := client.do(http.MethodGet, "/teapot", nil); err == nil || !strings.Contains(err.Error(), "418") {
+		t.Errorf("error without a body returned as %v", err)
+	}
+
+	client.token = "wrong"
+	if _, err := client.do(http.MethodGet, "/status", nil); err == nil || !strings.Contains(err.Error(), "invalid token") {
+		t.Errorf("wrong token returned %v", err)
+	}
+
+	if _, err := newAdminClient(&Config{}); err == nil {
+		t.Error("client created without admin_socket or admin_listen")
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
@@ -11,119 +12,212 @@ import (
 var (
 	lastEventTimes      = make(map[string]time.Time)
 	lastEventTimesMutex sync.Mutex
+	pendingEvents       = make(map[string]*pendingEvent)
+	pendingEventsMutex  sync.Mutex
 )
 
-// initializeWatcher sets up the directory watcher.
-// initializeWatcher sets up the directory watcher.
+// pendingEvent is a task held back by trailing-edge debouncing until its path goes quiet.
+type pendingEvent struct {
+	task       *Task
+	watch      *Watch
+	config     *Config
+	timer      *time.Timer
+	generation int // Bumped on every merge so stale timers can tell they were superseded
+}
+
+// initializeWatcher sets up the directory watcher for every accessible watch root.
 func initializeWatcher(config *Config) {
 	// Moved outside -> watcherChannel := make(chan notify.EventInfo, 100)
-	if err := notify.Watch(config.TargetPath+"/...", watcherChannel, notify.Create, notify.Write, notify.Remove, notify.Rename); err != nil {
-		logger.Fatalf("Error setting up watch: %v", err)
+	registered := make(map[string]bool)
+	for i := range config.Watches {
+		watch := &config.Watches[i]
+		if !isTargetAccessible(watch) {
+			logError("Target path %s is inaccessible. Not watching it for now.", watch.TargetPath)
+			continue
+		}
+		if err := notify.Watch(watch.TargetPath+"/...", watcherChannel, watchedEvents...); err != nil {
+			logFatal("Error setting up watch: %v", err)
+		}
+		registered[watch.ID] = true
 	}
+	setRegisteredWatches(registered)
 	// Moved outside -> return watcherChannel
 }
 
 // handleEvents is the main loop for processing file system events.
-func handleEvents(watcherChannel chan notify.EventInfo, taskQueue chan string, config *Config) {
+func handleEvents(watcherChannel chan notify.EventInfo, config *Config) {
 	for event := range watcherChannel {
 		eventPath := event.Path()
+
+		// Route the event to the watch whose root contains the path
+		watch := findWatch(eventPath, config)
+		if watch == nil {
+			logInfo("Skipping event outside of any watch: %s", eventPath)
+			continue
+		}
+		// Moves into the tree also arrive as a create on Linux; count them once
+		if event.Event() != notify.Create || !isMoveEvent(event) {
+			metricEvents.inc(watch.ID, eventName(event.Event()))
+		}
+
+		// Changes to an ignore file take effect with the next event, they run no commands
+		if isIgnoreFile(eventPath, watch) {
+			logInfo("Ignore file changed: %s", eventPath)
+			forgetIgnoreFiles(filepath.Dir(eventPath))
+			continue
+		}
+
+		// Events are dropped while intake is paused; a rescan picks up what was missed
+		if intakePaused.Load() {
+			logInfo("Intake paused, dropping event for %s", eventPath)
+			metricSkipped.inc(watch.ID, "paused")
+			continue
+		}
+
+		// Markers and manifests release the data files they stand for, they run no commands
+		if isTriggerFile(eventPath, watch) {
+			if isManifest(eventPath, watch) {
+				forgetManifests(filepath.Dir(eventPath))
+			}
+			handleTriggerFile(eventPath, watch, config)
+			continue
+		}
+
 		switch event.Event() {
 		case notify.Create:
-			handleCreateEvent(eventPath, taskQueue, config, watcherChannel)
+			if isMoveEvent(event) {
+				continue // Reported again as a platform move event with both paths
+			}
+			handleCreateEvent(eventPath, watch, config, watcherChannel)
 		case notify.Rename:
-			handleRenameEvent(eventPath, taskQueue, config, watcherChannel)
+			handleRenameEvent(eventPath, "", watch, config, watcherChannel)
 		case notify.Write:
-			handleWriteEvent(eventPath, taskQueue, config)
+			handleWriteEvent(eventPath, watch, config)
 		case notify.Remove:
-			handleRemoveEvent(eventPath, taskQueue, config)
+			handleRemoveEvent(eventPath, watch, config)
+		default:
+			handleMoveEvent(event, watch, config, watcherChannel)
 		}
 	}
 }
 
+// eventName returns the metric label of a notify event.
+func eventName(event notify.Event) string {
+	switch event {
+	case notify.Create:
+		return "create"
+	case notify.Write:
+		return "write"
+	case notify.Remove:
+		return "remove"
+	case notify.Rename:
+		return "rename"
+	}
+	return "move" // Platform move events, paired into renames
+}
+
 // handleCreateEvent handles file/directory creation events.
-func handleCreateEvent(eventPath string, taskQueue chan string, config *Config, watcherChannel chan notify.EventInfo) {
-	if isExcludedPath(eventPath, config) {
-		logger.Printf("Skipping excluded path: %s", eventPath)
+func handleCreateEvent(eventPath string, watch *Watch, config *Config, watcherChannel chan notify.EventInfo) {
+	if isExcludedPath(eventPath, watch) {
+		logInfo("Skipping excluded path: %s", eventPath)
+		metricSkipped.inc(watch.ID, "excluded")
 		return
 	}
 
 	fi, err := os.Stat(eventPath)
 	if err != nil {
-		logger.Printf("Error stating file %s: %v", eventPath, err)
+		logError("Error stating file %s: %v", eventPath, err)
 		return
 	}
 
 	if fi.IsDir() {
-		logger.Println("Detected new directory:", eventPath)
+		logInfo("Detected new directory: %s", eventPath)
+		forgetIgnoreFiles(eventPath)
+		forgetManifests(eventPath)
 		watchNewDirectory(eventPath, watcherChannel)
-	} else if fi.Mode().IsRegular() && isAllowedFileType(eventPath, config.FileTypes) {
-		logger.Println("New file created:", eventPath)
+	} else if fi.Mode().IsRegular() && isIncludedFile(eventPath, watch) {
+		logInfo("New file created: %s", eventPath)
 		// Execute command specific to Create event
-		if len(config.OnCreateRun) > 0 {
-			if shouldProcessEvent(eventPath, config) {
-				taskQueue <- eventPath + "?event=create"
-			}
-		}
+		submitTask(newTask(watch, eventPath, CreateEvent), watch, config)
 	}
 }
 
-// handleRenameEvent handles file/directory renaming events.
-func handleRenameEvent(eventPath string, taskQueue chan string, config *Config, watcherChannel chan notify.EventInfo) {
-	if isExcludedPath(eventPath, config) {
-		logger.Printf("Skipping excluded path: %s", eventPath)
+// handleRenameEvent handles file/directory renaming events. oldPath is the previous
+// path of the file if the platform reports it, or empty.
+func handleRenameEvent(eventPath, oldPath string, watch *Watch, config *Config, watcherChannel chan notify.EventInfo) {
+	if isExcludedPath(eventPath, watch) {
+		logInfo("Skipping excluded path: %s", eventPath)
+		metricSkipped.inc(watch.ID, "excluded")
 		return
 	}
 
 	fi, err := os.Stat(eventPath)
 	if err != nil {
-		logger.Printf("Error stating file %s: %v", eventPath, err)
+		logError("Error stating file %s: %v", eventPath, err)
 		return
 	}
+	if oldPath != "" {
+		forgetHashes(oldPath)
+	}
 
 	if fi.IsDir() {
-		logger.Println("Detected renamed directory:", eventPath)
+		logInfo("Detected renamed directory: %s", eventPath)
+		forgetIgnoreFiles(eventPath)
+		forgetManifests(eventPath)
 		watchNewDirectory(eventPath, watcherChannel)
-	} else if fi.Mode().IsRegular() && isAllowedFileType(eventPath, config.FileTypes) {
-		logger.Println("File renamed:", eventPath)
-		// Execute command specific to Rename event
-		if len(config.OnRenameRun) > 0 {
-			if shouldProcessEvent(eventPath, config) {
-				taskQueue <- eventPath + "?event=rename"
-			}
+	} else if fi.Mode().IsRegular() && isIncludedFile(eventPath, watch) {
+		// A file written under a temporary name and then given its real name is new
+		if watch.TempRenameAsCreate && oldPath != "" && isExcludedPath(oldPath, watch) {
+			logInfo("File renamed from excluded %s, handling as created: %s", oldPath, eventPath)
+			submitTask(newTask(watch, eventPath, CreateEvent), watch, config)
+			return
 		}
+
+		// Execute command specific to Rename event
+		task := newTask(watch, eventPath, RenameEvent)
+		task.OldPath = oldPath
+		logInfo("File renamed: %s", task)
+		submitTask(task, watch, config)
 	}
 }
 
 // handleWriteEvent handles file write events.
-func handleWriteEvent(eventPath string, taskQueue chan string, config *Config) {
-	if isAllowedFileType(eventPath, config.FileTypes) {
-		logger.Println("File modified:", eventPath)
+func handleWriteEvent(eventPath string, watch *Watch, config *Config) {
+	if isExcludedPath(eventPath, watch) {
+		logInfo("Skipping excluded path: %s", eventPath)
+		metricSkipped.inc(watch.ID, "excluded")
+		return
+	}
+
+	if isIncludedFile(eventPath, watch) {
+		logInfo("File modified: %s", eventPath)
 		// Execute command specific to Write event
-		if len(config.OnModifyRun) > 0 {
-			if shouldProcessEvent(eventPath, config) {
-				taskQueue <- eventPath + "?event=write"
-			}
-		}
+		submitTask(newTask(watch, eventPath, WriteEvent), watch, config)
 	}
 }
 
 // handleRemoveEvent handles file removal events.
-func handleRemoveEvent(eventPath string, taskQueue chan string, config *Config) {
-	logger.Printf("File or directory removed: %s", eventPath)
+func handleRemoveEvent(eventPath string, watch *Watch, config *Config) {
+	forgetIgnoreFiles(eventPath)
+	forgetManifests(eventPath)
+	forgetHashes(eventPath)
+	if isExcludedPath(eventPath, watch) {
+		logInfo("Skipping excluded path: %s", eventPath)
+		metricSkipped.inc(watch.ID, "excluded")
+		return
+	}
+	logInfo("File or directory removed: %s", eventPath)
 
 	// Execute command specific to Remove event
-	if len(config.OnRemoveRun) > 0 {
-		// Add the event path to the task queue with the "remove" event marker
-		taskQueue <- eventPath + "?event=remove"
-	}
+	submitTask(newTask(watch, eventPath, RemoveEvent), watch, config)
 }
 
 // watchNewDirectory starts watching a new directory recursively.
 func watchNewDirectory(dirPath string, watcherChannel chan notify.EventInfo) {
-	if err := notify.Watch(dirPath+"/...", watcherChannel, notify.Create, notify.Write, notify.Remove, notify.Rename); err != nil {
-		logger.Printf("Error watching new directory: %v", err)
+	if err := notify.Watch(dirPath+"/...", watcherChannel, watchedEvents...); err != nil {
+		logError("Error watching new directory: %v", err)
 	} else {
-		logger.Println("Now watching new directory:", dirPath)
+		logInfo("Now watching new directory: %s", dirPath)
 	}
 }
 
@@ -140,6 +234,112 @@ func shouldProcessEvent(eventPath string, config *Config) bool {
 		return true
 	}
 
-	logger.Printf("Debouncing event for %s", eventPath)
+	logInfo("Debouncing event for %s", eventPath)
+	metricDebounced.inc(DebounceModeLeading)
 	return false
 }
+
+// submitTask applies debouncing to a new task and passes it on to dispatchTask.
+func submitTask(task *Task, watch *Watch, config *Config) {
+	if task.Event != RemoveEvent && !triggerReady(task.Path, watch) {
+		logInfo("Holding %s until its marker or manifest appears", task.Path)
+		return
+	}
+
+	if config.DebounceMode == DebounceModeTrailing {
+		debounceTask(task, watch, config)
+		return
+	}
+
+	if !hasCommandsFor(watch, task.Event) {
+		return
+	}
+	// Remove events are not debounced in leading mode
+	if task.Event != RemoveEvent && !shouldProcessEvent(task.Path, config) {
+		return
+	}
+	dispatchTask(task, watch, config)
+}
+
+// debounceTask implements trailing-edge debouncing: events for a path are merged until no
+// new event has arrived for the debounce period, then a single task is dispatched.
+func debounceTask(task *Task, watch *Watch, config *Config) {
+	pendingEventsMutex.Lock()
+	defer pendingEventsMutex.Unlock()
+
+	delay := time.Duration(config.Debounce) * time.Millisecond
+	// A renamed file takes over what was pending under its old name
+	if previous, ok := pendingEvents[task.OldPath]; ok && task.OldPath != "" {
+		previous.timer.Stop()
+		delete(pendingEvents, task.OldPath)
+		defer inFlight.Add(-1) // Once the task is pending under its new name
+		if merged, _ := coalesceEvents(previous.task.Event, task.Event); merged == CreateEvent {
+			logInfo("Coalescing create of %s and its rename into a create of %s", task.OldPath, task.Path)
+			metricDebounced.inc(DebounceModeTrailing)
+			task.Event = CreateEvent
+			task.OldPath = ""
+		}
+	}
+
+	pending, exists := pendingEvents[task.Path]
+	if !exists {
+		pending = &pendingEvent{task: task, watch: watch, config: config}
+		pendingEvents[task.Path] = pending
+		inFlight.Add(1)
+	} else {
+		pending.timer.Stop()
+		metricDebounced.inc(DebounceModeTrailing)
+		merged, keep := coalesceEvents(pending.task.Event, task.Event)
+		if !keep {
+			logInfo("Dropping %s: %s followed by %s cancel out", task.Path, pending.task.Event, task.Event)
+			delete(pendingEvents, task.Path)
+			inFlight.Add(-1)
+			return
+		}
+		logInfo("Coalescing %s and %s events for %s into %s", pending.task.Event, task.Event, task.Path, merged)
+		pending.task.Event = merged
+		if task.OldPath != "" {
+			pending.task.OldPath = task.OldPath
+		}
+		pending.watch = watch
+		pending.generation++
+	}
+
+	generation := pending.generation
+	pending.timer = time.AfterFunc(delay, func() {
+		flushPendingEvent(pending, generation)
+	})
+}
+
+// flushPendingEvent dispatches a debounced task once its quiet period has passed.
+func flushPendingEvent(pending *pendingEvent, generation int) {
+	pendingEventsMutex.Lock()
+	if pendingEvents[pending.task.Path] != pending || pending.generation != generation {
+		// A newer event was merged in and rescheduled the flush
+		pendingEventsMutex.Unlock()
+		return
+	}
+	delete(pendingEvents, pending.task.Path)
+	pendingEventsMutex.Unlock()
+	defer inFlight.Add(-1)
+
+	if hasCommandsFor(pending.watch, pending.task.Event) {
+		dispatchTask(pending.task, pending.watch, pending.config)
+	}
+}
+
+// coalesceEvents merges two consecutive events for the same path into one. It returns
+// false when the events cancel each other out and nothing should run.
+func coalesceEvents(previous, next EventType) (EventType, bool) {
+	switch {
+	case previous == CreateEvent && next == RemoveEvent:
+		return "", false // Created and removed again before anything saw it
+	case previous == CreateEvent && (next == WriteEvent || next == RenameEvent):
+		return CreateEvent, true // Still a new file as far as commands are concerned
+	case previous == WriteEvent && next == RenameEvent:
+		return RenameEvent, true
+	case previous == RenameEvent && next == WriteEvent:
+		return RenameEvent, true
+	}
+	return next, true
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCoalesceEvents(t *testing.T) {
+	tests := []struct {
+		previous, next EventType
+		want           EventType
+		keep           bool
+	}{
+		{CreateEvent, RemoveEvent, "", false},
+		{CreateEvent, WriteEvent, CreateEvent, true},
+		{CreateEvent, RenameEvent, CreateEvent, true},
+		{CreateEvent, CreateEvent, CreateEvent, true},
+		{WriteEvent, RenameEvent, RenameEvent, true},
+		{RenameEvent, WriteEvent, RenameEvent, true},
+		{WriteEvent, WriteEvent, WriteEvent, true},
+		{WriteEvent, RemoveEvent, RemoveEvent, true},
+		{RenameEvent, RemoveEvent, RemoveEvent, true},
+		{RemoveEvent, CreateEvent, CreateEvent, true},
+	}
+	for _, tt := range tests {
+		got, keep := coalesceEvents(tt.previous, tt.next)
+		if got != tt.want || keep != tt.keep {
+			t.Errorf("coalesceEvents(%s, %s) = %q, %v, want %q, %v", tt.previous, tt.next, got, keep, tt.want, tt.keep)
+		}
+	}
+}
+
+func TestTrailingDebounce(t *testing.T) {
+	taskQueue = make(chan *Task, 10)
+	defer func() { taskQueue = nil }()
+
+	root := t.TempDir()
+	config := &Config{Debounce: 100, DebounceMode: DebounceModeTrailing}
+	watch := &Watch{ID: "test", root: root, OnCreateRun: []string{"echo"}, OnModifyRun: []string{"echo"}}
+
+	merged := filepath.Join(root, "merged.txt")
+	dropped := filepath.Join(root, "dropped.txt")
+	start := time.Now()
+	submitTask(&Task{Path: merged, Event: CreateEvent, WatchID: watch.ID}, watch, config)
+	submitTask(&Task{Path: dropped, Event: CreateEvent, WatchID: watch.ID}, watch, config)
+	time.Sleep(50 * time.Millisecond)
+	submitTask(&Task{Path: merged, Event: WriteEvent, WatchID: watch.ID}, watch, config)
+	submitTask(&Task{Path: dropped, Event: RemoveEvent, WatchID: watch.ID}, watch, config)
+
+	select {
+	case task := <-taskQueue:
+		if task.Path != merged || task.Event != CreateEvent {
+			t.Errorf("got %s event for %s, want one create event for %s", task.Event, task.Path, merged)
+		}
+		if waited := time.Since(start); waited < 150*time.Millisecond {
+			t.Errorf("task was queued after %v, before the path had been quiet for the debounce time", waited)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no task was queued")
+	}
+
+	select {
+	case task := <-taskQueue:
+		t.Errorf("unexpected %s task for %s", task.Event, task.Path)
+	case <-time.After(250 * time.Millisecond):
+	}
+}
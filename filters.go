@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sniffLength is the number of bytes http.DetectContentType looks at.
+const sniffLength = 512
+
+var (
+	agingFiles      = make(map[string]*agingFile) // Tasks held until their file reaches min_age, by path
+	agingFilesMutex sync.Mutex
+)
+
+// agingFile is a task held until its file is old enough for the min_age of its watch.
+type agingFile struct {
+	task  *Task
+	timer *time.Timer
+}
+
+// FileFilter holds conditions on the size, age and content type of a file. Empty
+// conditions match every file.
+type FileFilter struct {
+	MinSize   int64    `yaml:"min_size,omitempty"`  // Bytes, 0 = no lower limit
+	MaxSize   int64    `yaml:"max_size,omitempty"`  // Bytes, 0 = no upper limit
+	MinAge    int      `yaml:"min_age,omitempty"`   // Seconds since the last modification, 0 = no lower limit
+	MaxAge    int      `yaml:"max_age,omitempty"`   // Seconds since the last modification, 0 = no upper limit
+	MimeTypes []string `yaml:"mime_type,omitempty"` // Sniffed from the content, e.g. "application/pdf" or "image/*"
+}
+
+// isEmpty reports whether the filter has no conditions.
+func (f *FileFilter) isEmpty() bool {
+	return f.MinSize == 0 && f.MaxSize == 0 && f.MinAge == 0 && f.MaxAge == 0 && len(f.MimeTypes) == 0
+}
+
+// validate checks the filter for impossible or malformed conditions.
+func (f *FileFilter) validate() error {
+	if f.MinSize < 0 || f.MaxSize < 0 || f.MinAge < 0 || f.MaxAge < 0 {
+		return fmt.Errorf("sizes and ages must not be negative")
+	}
+	if f.MaxSize > 0 && f.MinSize > f.MaxSize {
+		return fmt.Errorf("min_size is larger than max_size")
+	}
+	if f.MaxAge > 0 && f.MinAge > f.MaxAge {
+		return fmt.Errorf("min_age is larger than max_age")
+	}
+	for _, mimeType := range f.MimeTypes {
+		if !strings.Contains(mimeType, "/") {
+			return fmt.Errorf("invalid mime_type %q, expected type/subtype or type/*", mimeType)
+		}
+	}
+	return nil
+}
+
+// rejectReason checks a file against the filter. It returns "" if the file passes, or
+// why it doesn't.
+func (f *FileFilter) rejectReason(filePath string) string {
+	reason, _ := f.check(filePath)
+	return reason
+}
+
+// check is rejectReason that also tells how long a file that fails only because it is
+// younger than min_age has to wait until it passes. The wait is 0 for other failures.
+func (f *FileFilter) check(filePath string) (string, time.Duration) {
+	if f == nil || f.isEmpty() {
+		return "", 0
+	}
+
+	fi, err := os.Stat(filePath)
+	if err != nil {
+		return fmt.Sprintf("cannot check file: %v", err), 0
+	}
+
+	if fi.Size() < f.MinSize {
+		return fmt.Sprintf("size %d is below min_size %d", fi.Size(), f.MinSize), 0
+	}
+	if f.MaxSize > 0 && fi.Size() > f.MaxSize {
+		return fmt.Sprintf("size %d is above max_size %d", fi.Size(), f.MaxSize), 0
+	}
+
+	age := time.Since(fi.ModTime())
+	if f.MaxAge > 0 && age > time.Duration(f.MaxAge)*time.Second {
+		return fmt.Sprintf("modified %v ago, more than max_age %ds", age.Round(time.Second), f.MaxAge), 0
+	}
+
+	if len(f.MimeTypes) > 0 {
+		mimeType, err := detectMimeType(filePath)
+		if err != nil {
+			return fmt.Sprintf("cannot detect content type: %v", err), 0
+		}
+		if !matchesMimeType(mimeType, f.MimeTypes) {
+			return fmt.Sprintf("content type %s is not in mime_type", mimeType), 0
+		}
+	}
+
+	// Checked last, so that a wait means the file passes once it is old enough
+	if minAge := time.Duration(f.MinAge) * time.Second; f.MinAge > 0 && age < minAge {
+		return fmt.Sprintf("modified %v ago, less than min_age %ds", age.Round(time.Second), f.MinAge), minAge - age
+	}
+	return "", 0
+}
+
+// holdUntilOldEnough holds a task whose file is younger than min_age and passes it to
+// enqueueOrBatchTask again once the file is old enough. A later event for the same file
+// is merged into the held task, which takes the place of the earlier one in the journal.
+func holdUntilOldEnough(task *Task, wait time.Duration, config *Config) {
+	agingFilesMutex.Lock()
+	defer agingFilesMutex.Unlock()
+
+	held, holding := agingFiles[task.Path]
+	if holding {
+		held.timer.Stop()
+		if merged, keep := coalesceEvents(held.task.Event, task.Event); keep {
+			task.Event = merged
+		}
+	}
+	journal.recordEnqueue(task)
+	if holding && held.task.ID != task.ID {
+		journal.recordAck(held.task)
+	}
+	logInfo("Holding %s for %v until it reaches min_age", task.Path, wait.Round(time.Second))
+
+	aging := &agingFile{task: task}
+	aging.timer = time.AfterFunc(wait, func() {
+		agingFilesMutex.Lock()
+		current := agingFiles[task.Path] == aging
+		if current {
+			delete(agingFiles, task.Path)
+		}
+		agingFilesMutex.Unlock()
+
+		if current {
+			enqueueOrBatchTask(task, config)
+			inFlight.Add(-1)
+		}
+	})
+	agingFiles[task.Path] = aging
+	if !holding {
+		inFlight.Add(1)
+	}
+}
+
+// detectMimeType returns the media type of a file, sniffed from its first bytes.
+func detectMimeType(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	buf := make([]byte, sniffLength)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+
+	// Drop parameters such as "; charset=utf-8"
+	mediaType, _, err := mime.ParseMediaType(http.DetectContentType(buf[:n]))
+	if err != nil {
+		return "", err
+	}
+	return mediaType, nil
+}
+
+// matchesMimeType reports whether mediaType is one of the patterns. A pattern can
+// end in "/*" to match every subtype.
+func matchesMimeType(mediaType string, patterns []string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == mediaType {
+			return true
+		}
+		if strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+	}
+	return false
+}
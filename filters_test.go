@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileFilterRejectReason(t *testing.T) {
+	dir := t.TempDir()
+	text := filepath.Join(dir, "notes.txt")
+	pdf := filepath.Join(dir, "doc.pdf")
+	old := filepath.Join(dir, "old.txt")
+	for path, content := range map[string]string{text: "hello world", pdf: "%PDF-1.7 document", old: "old"} {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	twoHoursAgo := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(old, twoHoursAgo, twoHoursAgo); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(filter FileFilter, path string, wantReason string) {
+		t.Helper()
+		reason := filter.rejectReason(path)
+		if wantReason == "" && reason != "" {
+			t.Errorf("%+v rejected %s: %s", filter, filepath.Base(path), reason)
+		}
+		if wantReason != "" && !strings.Contains(reason, wantReason) {
+			t.Errorf("%+v on %s: reason %q, want it to mention %q", filter, filepath.Base(path), reason, wantReason)
+		}
+	}
+
+	check(FileFilter{}, filepath.Join(dir, "missing"), "")
+	check(FileFilter{MinSize: 5}, text, "")
+	check(FileFilter{MinSize: 50}, text, "below min_size")
+	check(FileFilter{MaxSize: 5}, text, "above max_size")
+	check(FileFilter{MinAge: 3600}, old, "")
+	check(FileFilter{MinAge: 3600}, text, "less than min_age")
+	check(FileFilter{MaxAge: 3600}, old, "more than max_age")
+	check(FileFilter{MimeTypes: []string{"application/pdf"}}, pdf, "")
+	check(FileFilter{MimeTypes: []string{"text/*"}}, text, "")
+	check(FileFilter{MimeTypes: []string{"image/*", "application/pdf"}}, text, "not in mime_type")
+	check(FileFilter{MinSize: 1}, filepath.Join(dir, "missing"), "cannot check file")
+
+	var nilFilter *FileFilter
+	if reason := nilFilter.rejectReason(text); reason != "" {
+		t.Errorf("nil filter rejected a file: %s", reason)
+	}
+}
+
+func TestFileFilterValidate(t *testing.T) {
+	if err := (&FileFilter{MinSize: 1, MaxSize: 2, MinAge: 1, MaxAge: 2, MimeTypes: []string{"image/*"}}).validate(); err != nil {
+		t.Errorf("valid filter: %v", err)
+	}
+	for _, filter := range []FileFilter{
+		{MinSize: -1},
+		{MinSize: 3, MaxSize: 2},
+		{MinAge: 3, MaxAge: 2},
+		{MimeTypes: []string{"pdf"}},
+	} {
+		if err := filter.validate(); err == nil {
+			t.Errorf("%+v was accepted", filter)
+		}
+	}
+}
+
+func TestProcessFileAppliesFilters(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh")
+	}
+	root := t.TempDir()
+	watch := Watch{ID: "test", TargetPath: root}
+	watch.MinSize = 3
+	watch.Rules = []Rule{{Actions: []Action{
+		{Run: []string{"sh", "-c", "echo image >> ran"}, When: &FileFilter{MimeTypes: []string{"image/*"}}},
+		{Run: []string{"sh", "-c", "echo any >> ran"}},
+	}}}
+	config := &Config{Watches: []Watch{watch}}
+	if err := normalizeWatches(config); err != nil {
+		t.Fatal(err)
+	}
+
+	ran := func() string {
+		data, _ := os.ReadFile(filepath.Join(root, "ran"))
+		os.Remove(filepath.Join(root, "ran"))
+		return strings.TrimSpace(string(data))
+	}
+
+	small := filepath.Join(root, "small.txt")
+	text := filepath.Join(root, "text.txt")
+	os.WriteFile(small, []byte("x"), 0644)
+	os.WriteFile(text, []byte("plain text"), 0644)
+
+	if err := processFile(context.Background(), &Task{Path: small, Event: CreateEvent, WatchID: "test"}, config); err != nil {
+		t.Fatal(err)
+	}
+	if got := ran(); got != "" {
+		t.Errorf("file below the watch min_size ran %q", got)
+	}
+
+	if err := processFile(context.Background(), &Task{Path: text, Event: CreateEvent, WatchID: "test"}, config); err != nil {
+		t.Fatal(err)
+	}
+	if got := ran(); got != "any" {
+		t.Errorf("text file ran %q, want only the action without when", got)
+	}
+}
+
+func TestFileFilterCheckWaitsForMinAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "new.txt")
+	if err := os.WriteFile(path, []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	reason, wait := (&FileFilter{MinAge: 60}).check(path)
+	if reason == "" || wait <= 50*time.Second || wait > 60*time.Second {
+		t.Errorf("young file: reason %q, wait %v, want a wait of up to min_age", reason, wait)
+	}
+	// A file that fails another filter as well doesn't wait
+	if reason, wait := (&FileFilter{MinAge: 60, MinSize: 100}).check(path); reason == "" || wait != 0 {
+		t.Errorf("small young file: reason %q, wait %v, want no wait", reason, wait)
+	}
+}
+
+func TestEnqueueOrBatchTaskFilters(t *testing.T) {
+	taskQueue = make(chan *Task, 10)
+	defer func() { taskQueue = nil }()
+
+	root := t.TempDir()
+	entry := Watch{ID: "test", TargetPath: root}
+	entry.MinSize = 3
+	entry.MinAge = 1
+	config := &Config{Watches: []Watch{entry}}
+	if err := normalizeWatches(config); err != nil {
+		t.Fatal(err)
+	}
+	watch := &config.Watches[0]
+
+	small := filepath.Join(root, "small.txt")
+	fresh := filepath.Join(root, "fresh.txt")
+	os.WriteFile(small, []byte("x"), 0644)
+	os.WriteFile(fresh, []byte("fresh"), 0644)
+
+	enqueueOrBatchTask(newTask(watch, small, CreateEvent), config)
+	enqueueOrBatchTask(newTask(watch, fresh, CreateEvent), config)
+	enqueueOrBatchTask(newTask(watch, fresh, WriteEvent), config)
+	if len(taskQueue) != 0 {
+		t.Fatalf("%d tasks queued right away, want the small file dropped and the fresh one held", len(taskQueue))
+	}
+
+	select {
+	case task := <-taskQueue:
+		if task.Path != fresh || task.Event != CreateEvent {
+			t.Errorf("queued %s, want the create of the fresh file", task)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("fresh file was not queued once it reached min_age")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if len(taskQueue) != 0 {
+		t.Errorf("%d more tasks queued, want the held events merged into one", len(taskQueue))
+	}
+
+	forced := newTask(watch, small, CreateEvent)
+	forced.Force = true
+	enqueueOrBatchTask(forced, config)
+	if len(taskQueue) != 1 {
+		t.Error("forced task was filtered")
+	}
+}
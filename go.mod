@@ -3,8 +3,10 @@ module WatchThatDir
 go 1.23.4
 
 require (
+	github.com/cespare/xxhash/v2 v2.3.0
 	github.com/rjeczalik/notify v0.9.3
+	golang.org/x/sys v0.0.0-20180926160741-c2ed4eda69e7
 	gopkg.in/yaml.v3 v3.0.1
 )
 
-require golang.org/x/sys v0.0.0-20180926160741-c2ed4eda69e7 // indirect
+require github.com/bmatcuk/doublestar/v4 v4.10.0
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// Constants for hash_algorithm values.
+const (
+	HashAlgorithmSHA256 = "sha256"
+	HashAlgorithmXXHash = "xxhash"
+)
+
+// errFileTooLarge is returned by hashFile for files above the size cap.
+var errFileTooLarge = errors.New("file is larger than hash_max_size")
+
+var (
+	lastHashes      = make(map[string]string) // Content hash of each file when it was last processed
+	lastHashesMutex sync.Mutex
+)
+
+// hashFile returns the hex encoded content hash of a file using the given algorithm.
+// Files larger than maxSize are not hashed (0 = no limit).
+func hashFile(filePath, algorithm string, maxSize int64) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if maxSize > 0 {
+		fi, err := f.Stat()
+		if err != nil {
+			return "", err
+		}
+		if fi.Size() > maxSize {
+			return "", errFileTooLarge
+		}
+	}
+
+	var h hash.Hash
+	switch algorithm {
+	case HashAlgorithmSHA256:
+		h = sha256.New()
+	case HashAlgorithmXXHash:
+		h = xxhash.New()
+	default:
+		return "", fmt.Errorf("unknown hash algorithm: %s", algorithm)
+	}
+
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	if algorithm == HashAlgorithmXXHash {
+		// Same width as the sum, without leading zeros dropped
+		return fmt.Sprintf("%016s", strconv.FormatUint(h.(*xxhash.Digest).Sum64(), 16)), nil
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// isIdenticalWrite hashes the file of a task and reports whether the task is a write event
+// that left the content identical to the version last processed. The hash is kept in the
+// task, so that it is remembered once the file has been processed. It runs on the worker,
+// as hashing a large file would hold up the event loop.
+func isIdenticalWrite(task *Task, config *Config) bool {
+	hash, err := hashFile(task.Path, config.HashAlgorithm, config.HashMaxSize)
+	if err != nil {
+		logError("Not comparing content of %s: %v", task.Path, err)
+		return false
+	}
+	if task.Event == WriteEvent && hash == lastProcessedHash(task.Path) {
+		return true
+	}
+	task.Hash = hash
+	return false
+}
+
+// lastProcessedHash returns the content hash of a file when it was last processed, or "".
+// Files not processed since startup fall back to the hash in the state store.
+func lastProcessedHash(filePath string) string {
+	lastHashesMutex.Lock()
+	hash, ok := lastHashes[filePath]
+	lastHashesMutex.Unlock()
+	if ok {
+		return hash
+	}
+	return stateDB.processedHash(filePath)
+}
+
+// rememberHash records the content hash of a successfully processed task. Only files that
+// stay where they are are remembered; moved and deleted ones can't be written to again.
+func rememberHash(task *Task, watch *Watch) {
+	lastHashesMutex.Lock()
+	defer lastHashesMutex.Unlock()
+
+	if task.OldPath != "" {
+		delete(lastHashes, task.OldPath)
+	}
+	switch {
+	case task.Event == RemoveEvent || watch.PostProcessAction != PostProcessActionDoNothing:
+		delete(lastHashes, task.Path)
+	case task.Hash != "":
+		lastHashes[task.Path] = task.Hash
+	}
+}
+
+// forgetHashes drops the remembered hashes of a removed or renamed file, or of every file
+// below a removed directory.
+func forgetHashes(path string) {
+	lastHashesMutex.Lock()
+	defer lastHashesMutex.Unlock()
+
+	delete(lastHashes, path)
+	prefix := strings.TrimSuffix(path, string(filepath.Separator)) + string(filepath.Separator)
+	for filePath := range lastHashes {
+		if strings.HasPrefix(filePath, prefix) {
+			delete(lastHashes, filePath)
+		}
+	}
+}
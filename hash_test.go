@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHashFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "abc.txt")
+	if err := os.WriteFile(path, []byte("abc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		algorithm string
+		want      string
+	}{
+		{HashAlgorithmSHA256, "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{HashAlgorithmXXHash, "44bc2cf5ad770999"},
+	}
+	for _, tt := range tests {
+		got, err := hashFile(path, tt.algorithm, 0)
+		if err != nil || got != tt.want {
+			t.Errorf("hashFile(%s) = %q, %v, want %q", tt.algorithm, got, err, tt.want)
+		}
+	}
+
+	if _, err := hashFile(path, HashAlgorithmSHA256, 2); !errors.Is(err, errFileTooLarge) {
+		t.Errorf("hashing above hash_max_size: %v, want errFileTooLarge", err)
+	}
+	if _, err := hashFile(path, "md5", 0); err == nil {
+		t.Error("unknown algorithm was accepted")
+	}
+}
+
+func TestFilesToProcessSkipsIdenticalWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.csv")
+	if err := os.WriteFile(path, []byte("a,b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer forgetHashes(path)
+	watch := &Watch{ID: "test"}
+	config := &Config{SkipIdenticalWrites: true, HashAlgorithm: HashAlgorithmSHA256}
+	kept := func(task *Task) bool {
+		return len(filesToProcess([]*Task{task}, watch, config)) == 1
+	}
+
+	first := &Task{Path: path, Event: WriteEvent}
+	if !kept(first) || first.Hash == "" {
+		t.Fatalf("first write was not kept with its hash (hash %q)", first.Hash)
+	}
+	rememberHash(first, watch)
+
+	if kept(&Task{Path: path, Event: WriteEvent}) {
+		t.Error("write that left the content unchanged was kept")
+	}
+	if !kept(&Task{Path: path, Event: WriteEvent, Force: true}) {
+		t.Error("forced write with unchanged content was skipped")
+	}
+	if !kept(&Task{Path: path, Event: CreateEvent}) {
+		t.Error("create event with known content was skipped")
+	}
+
+	if err := os.WriteFile(path, []byte("c,d"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !kept(&Task{Path: path, Event: WriteEvent}) {
+		t.Error("write that changed the content was skipped")
+	}
+}
+
+func TestRememberAndForgetHashes(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "in")
+	inPlace := &Watch{ID: "test"}
+	moved := &Watch{ID: "test", PostProcessAction: PostProcessActionMove}
+	remembered := func(path string) bool { return lastProcessedHash(path) != "" }
+
+	a, b, c := filepath.Join(dir, "a.csv"), filepath.Join(dir, "sub", "b.csv"), filepath.Join(dir+"2", "c.csv")
+	for _, path := range []string{a, b, c} {
+		rememberHash(&Task{Path: path, Event: CreateEvent, Hash: "h"}, inPlace)
+	}
+	defer forgetHashes(c)
+
+	rememberHash(&Task{Path: filepath.Join(dir, "gone.csv"), Event: CreateEvent, Hash: "h"}, moved)
+	if remembered(filepath.Join(dir, "gone.csv")) {
+		t.Error("hash of a file moved by post_process was remembered")
+	}
+
+	forgetHashes(a)
+	if remembered(a) || !remembered(b) {
+		t.Error("forgetting a file forgot the wrong hashes")
+	}
+	forgetHashes(dir)
+	if remembered(b) || !remembered(c) {
+		t.Error("forgetting a directory did not forget just the files below it")
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	startTime = time.Now()
+
+	registeredWatches      = make(map[string]bool) // Watch IDs whose root the watcher is registered for
+	registeredWatchesMutex sync.Mutex
+)
+
+// workerHealth describes a busy worker in the /healthz response.
+type workerHealth struct {
+	ID          int     `json:"id"`
+	Task        string  `json:"task"`
+	BusySeconds float64 `json:"busy_seconds"`
+	Stuck       bool    `json:"stuck"`
+}
+
+// healthReport is the /healthz response.
+type healthReport struct {
+	Status        string         `json:"status"`
+	UptimeSeconds float64        `json:"uptime_seconds"`
+	Workers       int            `json:"workers"`
+	BusyWorkers   []workerHealth `json:"busy_workers"`
+	Problems      []string       `json:"problems,omitempty"`
+}
+
+// watchReadiness describes a watch in the /readyz response.
+type watchReadiness struct {
+	ID         string `json:"id"`
+	TargetPath string `json:"target_path"`
+	Registered bool   `json:"registered"`
+	Accessible bool   `json:"accessible"`
+}
+
+// readinessReport is the /readyz response.
+type readinessReport struct {
+	Status     string             `json:"status"`
+	Watches    []watchReadiness   `json:"watches"`
+	Queues     map[string]float64 `json:"queues"`
+	QueueLimit int                `json:"queue_limit"`
+	Problems   []string           `json:"problems,omitempty"`
+}
+
+// setRegisteredWatches records the watches the watcher is currently registered for.
+func setRegisteredWatches(ids map[string]bool) {
+	registeredWatchesMutex.Lock()
+	defer registeredWatchesMutex.Unlock()
+	registeredWatches = ids
+}
+
+// isWatchRegistered reports whether the watcher is registered for the root of a watch.
+func isWatchRegistered(id string) bool {
+	registeredWatchesMutex.Lock()
+	defer registeredWatchesMutex.Unlock()
+	return registeredWatches[id]
+}
+
+// checkHealth reports whether the process is alive and no worker is stuck on a task
+// for longer than stall_timeout.
+func checkHealth(config *Config) healthReport {
+	report := healthReport{
+		Status:        "ok",
+		UptimeSeconds: time.Since(startTime).Seconds(),
+		Workers:       int(totalWorkers.Load()),
+		BusyWorkers:   []workerHealth{},
+	}
+
+	for _, active := range activeTaskList() {
+		busy := time.Since(active.started)
+		stuck := config.StallTimeout > 0 && busy > time.Duration(config.StallTimeout)*time.Second
+		report.BusyWorkers = append(report.BusyWorkers, workerHealth{
+			ID:          active.workerID,
+			Task:        active.task.String(),
+			BusySeconds: busy.Seconds(),
+			Stuck:       stuck,
+		})
+		if stuck {
+			report.Problems = append(report.Problems, fmt.Sprintf("worker %d has been processing %s for %v", active.workerID, active.task, busy.Round(time.Second)))
+		}
+	}
+
+	if len(report.Problems) > 0 {
+		report.Status = "fail"
+	}
+	return report
+}
+
+// checkReadiness reports whether every watch is registered with the watcher and its
+// target is accessible, and no worker pool has ready_queue_limit or more queued tasks.
+func checkReadiness(config *Config) readinessReport {
+	report := readinessReport{
+		Status:     "ok",
+		Queues:     queueDepths(),
+		QueueLimit: config.ReadyQueueLimit,
+	}
+
+	for i := range config.Watches {
+		watch := &config.Watches[i]
+		readiness := watchReadiness{
+			ID:         watch.ID,
+			TargetPath: watch.TargetPath,
+			Registered: isWatchRegistered(watch.ID),
+			Accessible: isTargetAccessible(watch),
+		}
+		report.Watches = append(report.Watches, readiness)
+		if !readiness.Accessible {
+			report.Problems = append(report.Problems, fmt.Sprintf("target path %s of watch %s is inaccessible", watch.TargetPath, watch.ID))
+		} else if !readiness.Registered {
+			report.Problems = append(report.Problems, fmt.Sprintf("watcher is not registered for %s of watch %s", watch.TargetPath, watch.ID))
+		}
+	}
+
+	if config.ReadyQueueLimit > 0 {
+		for _, pool := range sortedKeys(report.Queues) {
+			if depth := report.Queues[pool]; depth >= float64(config.ReadyQueueLimit) {
+				report.Problems = append(report.Problems, fmt.Sprintf("%v tasks queued in pool %s", depth, pool))
+			}
+		}
+	}
+
+	if len(report.Problems) > 0 {
+		report.Status = "fail"
+	}
+	return report
+}
+
+// handleHealth serves /healthz, with status 503 if a worker is stuck.
+func handleHealth(w http.ResponseWriter, r *http.Request, config *Config) {
+	report := checkHealth(config)
+	writeJSONStatus(w, report.Status, report)
+}
+
+// handleReadiness serves /readyz, with status 503 if the instance is not ready for events.
+func handleReadiness(w http.ResponseWriter, r *http.Request, config *Config) {
+	report := checkReadiness(config)
+	writeJSONStatus(w, report.Status, report)
+}
+
+// writeJSONStatus writes a JSON response, with status 503 unless status is "ok".
+func writeJSONStatus(w http.ResponseWriter, status string, body interface{}) {
+	code := http.StatusOK
+	if status != "ok" {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, body)
+}
+
+// writeJSON writes body as an indented JSON response with the given status code.
+func writeJSON(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(body); err != nil {
+		logError("Error writing HTTP response: %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleHealthReportsStuckWorkers(t *testing.T) {
+	startWork(901, &Task{ID: "slow", Path: "/in/slow.csv", Event: CreateEvent})
+	defer finishWork(901)
+	taskRegistryMutex.Lock()
+	activeTasks[901].started = time.Now().Add(-2 * time.Hour)
+	taskRegistryMutex.Unlock()
+
+	for _, tt := range []struct {
+		stallTimeout int
+		wantStatus   int
+	}{
+		{0, http.StatusOK},
+		{3 * 3600, http.StatusOK},
+		{3600, http.StatusServiceUnavailable},
+	} {
+		rec := httptest.NewRecorder()
+		handleHealth(rec, httptest.NewRequest("GET", "/healthz", nil), &Config{StallTimeout: tt.stallTimeout})
+		if rec.Code != tt.wantStatus {
+			t.Errorf("stall_timeout %d: status %d, want %d", tt.stallTimeout, rec.Code, tt.wantStatus)
+		}
+
+		var report healthReport
+		if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+			t.Fatal(err)
+		}
+		var worker *workerHealth
+		for i := range report.BusyWorkers {
+			if report.BusyWorkers[i].ID == 901 {
+				worker = &report.BusyWorkers[i]
+			}
+		}
+		if worker == nil || worker.Stuck != (tt.wantStatus != http.StatusOK) {
+			t.Errorf("stall_timeout %d: busy worker reported as %+v", tt.stallTimeout, worker)
+		}
+	}
+}
+
+func TestCheckReadiness(t *testing.T) {
+	taskQueue = make(chan *Task, 10)
+	defer func() { taskQueue = nil }()
+	defer setRegisteredWatches(nil)
+
+	root := t.TempDir()
+	config := &Config{ReadyQueueLimit: 2, Watches: []Watch{{ID: "docs", TargetPath: root}}}
+	if err := normalizeWatches(config); err != nil {
+		t.Fatal(err)
+	}
+
+	problems := func() string {
+		report := checkReadiness(config)
+		if (report.Status == "ok") != (len(report.Problems) == 0) {
+			t.Errorf("status %s with problems %q", report.Status, report.Problems)
+		}
+		return strings.Join(report.Problems, "; ")
+	}
+
+	if got := problems(); !strings.Contains(got, "not registered") {
+		t.Errorf("unregistered watch: problems %q", got)
+	}
+
+	setRegisteredWatches(map[string]bool{"docs": true})
+	if got := problems(); got != "" {
+		t.Errorf("ready instance has problems %q", got)
+	}
+
+	taskQueue <- &Task{}
+	taskQueue <- &Task{}
+	if got := problems(); !strings.Contains(got, "2 tasks queued in pool shared") {
+		t.Errorf("full queue: problems %q", got)
+	}
+	<-taskQueue
+	<-taskQueue
+
+	config.Watches[0].TargetPath = filepath.Join(root, "missing")
+	if got := problems(); !strings.Contains(got, "inaccessible") {
+		t.Errorf("missing target: problems %q", got)
+	}
+}
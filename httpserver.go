@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// startHTTPServer serves the monitoring endpoints on config.HTTPListen in the background.
+// It does nothing if no address is configured.
+func startHTTPServer(config *Config) {
+	if config.HTTPListen == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", handleMetrics)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		handleHealth(w, r, config)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		handleReadiness(w, r, config)
+	})
+
+	server := &http.Server{
+		Addr:              config.HTTPListen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		logInfo("Serving metrics and health checks on http://%s", config.HTTPListen)
+		if err := server.ListenAndServe(); err != nil {
+			logError("Error serving HTTP on %s: %v", config.HTTPListen, err)
+		}
+	}()
+}
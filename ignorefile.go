@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/bmatcuk/doublestar/v4"
+)
+
+var (
+	ignoreFiles      = make(map[string]*ignoreFile) // Parsed ignore files by directory, nil if the directory has none
+	ignoreFilesMutex sync.Mutex
+)
+
+// ignoreFile holds the patterns of a single .wtdignore file.
+type ignoreFile struct {
+	patterns []ignorePattern
+}
+
+// ignorePattern is one line of an ignore file, in gitignore syntax.
+type ignorePattern struct {
+	glob    string // doublestar pattern relative to the directory of the ignore file
+	negate  bool   // "!pattern" includes a path again
+	dirOnly bool   // "pattern/" only matches directories
+}
+
+// parseIgnoreFile reads an ignore file. Lines are gitignore patterns: blank lines and lines
+// starting with # are skipped, a leading ! negates, a trailing / only matches directories,
+// and a pattern without a / in front or in the middle matches a name at any depth.
+func parseIgnoreFile(path string, caseSensitive bool) (*ignoreFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ignore := &ignoreFile{}
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var p ignorePattern
+		if strings.HasPrefix(line, "!") {
+			p.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+			line = line[1:] // Escaped literal ! or #
+		}
+		if strings.HasSuffix(line, "/") {
+			p.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if strings.HasPrefix(line, "/") {
+			line = strings.TrimLeft(line, "/") // Anchored to the directory of the ignore file
+		} else if !strings.Contains(line, "/") {
+			line = "**/" + line
+		}
+		if !caseSensitive {
+			line = strings.ToLower(line)
+		}
+		if line == "" || !doublestar.ValidatePattern(line) {
+			logError("Ignoring invalid pattern on line %d of %s", lineNo, path)
+			continue
+		}
+		p.glob = line
+		ignore.patterns = append(ignore.patterns, p)
+	}
+	return ignore, scanner.Err()
+}
+
+// loadIgnoreFile returns the parsed ignore file of a directory, or nil if it has none.
+// Files are parsed once and kept until forgetIgnoreFiles is called for them.
+func loadIgnoreFile(dir string, watch *Watch) *ignoreFile {
+	ignoreFilesMutex.Lock()
+	defer ignoreFilesMutex.Unlock()
+
+	if ignore, ok := ignoreFiles[dir]; ok {
+		return ignore
+	}
+
+	path := filepath.Join(dir, watch.ignoreFileName)
+	ignore, err := parseIgnoreFile(path, watch.caseSensitive)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logError("Error reading ignore file %s: %v", path, err)
+		}
+		ignore = nil
+	} else {
+		logInfo("Loaded ignore file %s (%d patterns)", path, len(ignore.patterns))
+	}
+	ignoreFiles[dir] = ignore
+	return ignore
+}
+
+// forgetIgnoreFiles drops the cached ignore files of dir and every directory below it,
+// so they are read again the next time they are needed.
+func forgetIgnoreFiles(dir string) {
+	ignoreFilesMutex.Lock()
+	defer ignoreFilesMutex.Unlock()
+
+	for cached := range ignoreFiles {
+		if isWithinRoot(cached, dir) {
+			delete(ignoreFiles, cached)
+		}
+	}
+}
+
+// isIgnoreFile reports whether path is an ignore file of the watch.
+func isIgnoreFile(path string, watch *Watch) bool {
+	return watch.ignoreFileName != "" && filepath.Base(path) == watch.ignoreFileName
+}
+
+// isIgnoredByFiles checks absPath against the ignore files in the directories between the
+// watch root and the path. As in git, rules in deeper directories take precedence, and a
+// file inside an ignored directory cannot be included again.
+func isIgnoredByFiles(absPath string, watch *Watch) bool {
+	if watch.ignoreFileName == "" {
+		return false
+	}
+	relPath, err := filepath.Rel(watch.root, absPath)
+	if err != nil || relPath == "." || strings.HasPrefix(relPath, "..") {
+		return false
+	}
+	parts := strings.Split(filepath.ToSlash(relPath), "/")
+
+	// Load the ignore files of the root and of every directory above the path
+	files := make([]*ignoreFile, len(parts))
+	dir := watch.root
+	for i := range parts {
+		files[i] = loadIgnoreFile(dir, watch)
+		dir = filepath.Join(dir, parts[i])
+	}
+
+	// Check each directory from the top, then the path itself
+	for depth := 1; depth <= len(parts); depth++ {
+		isDir := depth < len(parts)
+		if !isDir {
+			if fi, err := os.Stat(absPath); err == nil {
+				isDir = fi.IsDir()
+			}
+		}
+
+		ignored := false
+		for level := 0; level < depth; level++ {
+			if files[level] == nil {
+				continue
+			}
+			subject := strings.Join(parts[level:depth], "/")
+			if !watch.caseSensitive {
+				subject = strings.ToLower(subject)
+			}
+			for _, p := range files[level].patterns {
+				if p.dirOnly && !isDir {
+					continue
+				}
+				if matched, _ := doublestar.Match(p.glob, subject); matched {
+					ignored = !p.negate
+				}
+			}
+		}
+		if ignored {
+			return true
+		}
+	}
+	return false
+}
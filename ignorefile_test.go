@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseIgnoreFile(t *testing.T) {
+	tests := []struct {
+		name          string
+		content       string
+		caseSensitive bool
+		want          []ignorePattern
+	}{
+		{"comments and blank lines", "# comment\n\n   \n", true, nil},
+		{"bare name", "*.tmp\n", true, []ignorePattern{{glob: "**/*.tmp"}}},
+		{"anchored", "/build\n", true, []ignorePattern{{glob: "build"}}},
+		{"path", "docs/*.md\n", true, []ignorePattern{{glob: "docs/*.md"}}},
+		{"directory only", "cache/\n", true, []ignorePattern{{glob: "**/cache", dirOnly: true}}},
+		{"negation", "!keep.tmp\n", true, []ignorePattern{{glob: "**/keep.tmp", negate: true}}},
+		{"escaped", "\\!bang\n\\#hash\n", true, []ignorePattern{{glob: "**/!bang"}, {glob: "**/#hash"}}},
+		{"trailing whitespace", "a.log  \t\r\n", true, []ignorePattern{{glob: "**/a.log"}}},
+		{"case insensitive", "*.TMP\n", false, []ignorePattern{{glob: "**/*.tmp"}}},
+		{"invalid pattern is skipped", "[x\nok\n", true, []ignorePattern{{glob: "**/ok"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), ".wtdignore")
+			if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			ignore, err := parseIgnoreFile(path, tt.caseSensitive)
+			if err != nil {
+				t.Fatalf("parseIgnoreFile: %v", err)
+			}
+			if !reflect.DeepEqual(ignore.patterns, tt.want) {
+				t.Errorf("patterns = %+v, want %+v", ignore.patterns, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsIgnoredByFiles(t *testing.T) {
+	root := t.TempDir()
+	watch := &Watch{ID: "test", root: root, ignoreFileName: ".wtdignore", caseSensitive: true}
+	ignoreFiles := map[string]string{
+		".wtdignore":     "*.tmp\ncache/\n/top.txt\nsub/skip\n",
+		"sub/.wtdignore": "!keep.tmp\nlocal.txt\n",
+	}
+	for name, content := range ignoreFiles {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.MkdirAll(filepath.Join(root, "cache"), 0755)
+	defer forgetIgnoreFiles(root)
+
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"a.txt", false},
+		{"a.tmp", true},
+		{"deep/down/a.tmp", true},
+		{"cache", true},
+		{"cache/x.txt", true},
+		{"top.txt", true},
+		{"other/top.txt", false},
+		{"sub/skip", true},
+		{"sub/keep.tmp", false},
+		{"sub/other.tmp", true},
+		{"sub/local.txt", true},
+		{"local.txt", false},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(root, filepath.FromSlash(tt.path))
+		if got := isIgnoredByFiles(path, watch); got != tt.want {
+			t.Errorf("isIgnoredByFiles(%s) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
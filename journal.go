@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Constants for journal record operations.
+const (
+	journalOpEnqueue = "enqueue"
+	journalOpAck     = "ack"
+)
+
+// journalRecord is a single line of the task journal.
+type journalRecord struct {
+	Op   string `json:"op"`
+	ID   string `json:"id,omitempty"`   // Set for acks
+	Task *Task  `json:"task,omitempty"` // Set for enqueues
+}
+
+// journalEntry is a task that was queued but not yet acknowledged.
+type journalEntry struct {
+	seq  int
+	task *Task
+}
+
+// taskJournal is an append-only log of queued and completed tasks, so that tasks that were
+// queued or in flight when the process stopped are run again on the next start.
+type taskJournal struct {
+	mu           sync.Mutex
+	path         string
+	file         *os.File
+	pending      map[string]journalEntry
+	seq          int
+	acked        int // Acks written since the last compaction
+	compactAfter int
+}
+
+// openJournal opens the journal at path, creating it if needed, and returns it together
+// with the tasks that were never acknowledged, in the order they were queued.
+func openJournal(path string, compactAfter int) (*taskJournal, []*Task, error) {
+	j := &taskJournal{
+		path:         path,
+		pending:      make(map[string]journalEntry),
+		compactAfter: compactAfter,
+	}
+
+	if err := j.replay(); err != nil {
+		return nil, nil, err
+	}
+	// Start from a compacted file holding only the outstanding tasks
+	if err := j.compact(); err != nil {
+		return nil, nil, err
+	}
+
+	// Hand out copies, the journal keeps its own
+	var tasks []*Task
+	for _, task := range j.pendingTasks() {
+		replayed := *task
+		tasks = append(tasks, &replayed)
+	}
+	return j, tasks, nil
+}
+
+// replay reads the journal file and rebuilds the set of outstanding tasks.
+func (j *taskJournal) replay() error {
+	f, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error opening journal %s: %w", j.path, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var record journalRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// Most likely a record cut short by a crash
+			logError("Skipping unreadable journal record at line %d: %v", line, err)
+			continue
+		}
+		switch {
+		case record.Op == journalOpEnqueue && record.Task != nil:
+			// A batch replaces its files, in case their acks didn't make it to disk
+			for _, file := range record.Task.Batch {
+				delete(j.pending, file.ID)
+			}
+			j.seq++
+			j.pending[record.Task.ID] = journalEntry{seq: j.seq, task: record.Task}
+		case record.Op == journalOpAck:
+			delete(j.pending, record.ID)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading journal %s: %w", j.path, err)
+	}
+	return nil
+}
+
+// pendingTasks returns the outstanding tasks in the order they were queued.
+func (j *taskJournal) pendingTasks() []*Task {
+	entries := make([]journalEntry, 0, len(j.pending))
+	for _, entry := range j.pending {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(a, b int) bool { return entries[a].seq < entries[b].seq })
+
+	tasks := make([]*Task, len(entries))
+	for i, entry := range entries {
+		tasks[i] = entry.task
+	}
+	return tasks
+}
+
+// recordEnqueue writes a queued task to the journal. It is a no-op on a nil journal.
+func (j *taskJournal) recordEnqueue(task *Task) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, exists := j.pending[task.ID]; exists {
+		return // Replayed task, already in the journal
+	}
+	// Keep a snapshot; workers update the task while it runs
+	snapshot := *task
+	j.seq++
+	j.pending[task.ID] = journalEntry{seq: j.seq, task: &snapshot}
+	if err := j.write(journalRecord{Op: journalOpEnqueue, Task: task}, true); err != nil {
+		logError("Error writing task %s to journal: %v", task, err)
+	}
+}
+
+// recordAck marks a task as completed in the journal. It is a no-op on a nil journal.
+func (j *taskJournal) recordAck(task *Task) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, exists := j.pending[task.ID]; !exists {
+		return
+	}
+	delete(j.pending, task.ID)
+	if err := j.write(journalRecord{Op: journalOpAck, ID: task.ID}, false); err != nil {
+		logError("Error writing acknowledgement of task %s to journal: %v", task, err)
+		return
+	}
+
+	j.acked++
+	if j.compactAfter > 0 && j.acked >= j.compactAfter {
+		if err := j.compact(); err != nil {
+			logError("Error compacting journal: %v", err)
+		}
+	}
+}
+
+// isPending reports whether a task for the given path is waiting in the journal.
+func (j *taskJournal) isPending(path string) bool {
+	if j == nil {
+		return false
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for _, entry := range j.pending {
+		for _, file := range entry.task.files() {
+			if file.Path == path {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// write appends a record to the journal file, syncing it to disk if requested.
+// The caller must hold j.mu.
+func (j *taskJournal) write(record journalRecord, sync bool) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := j.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if sync {
+		return j.file.Sync()
+	}
+	return nil
+}
+
+// compact rewrites the journal so it only holds the outstanding tasks, then reopens it
+// for appending. The caller must hold j.mu, or be the only user of j.
+func (j *taskJournal) compact() error {
+	tmpPath := j.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("error creating journal %s: %w", tmpPath, err)
+	}
+
+	w := bufio.NewWriter(tmp)
+	for _, task := range j.pendingTasks() {
+		data, err := json.Marshal(journalRecord{Op: journalOpEnqueue, Task: task})
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		w.Write(append(data, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing journal %s: %w", tmpPath, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error syncing journal %s: %w", tmpPath, err)
+	}
+	tmp.Close()
+
+	if j.file != nil {
+		j.file.Close()
+	}
+	if err := os.Rename(tmpPath, j.path); err != nil {
+		return fmt.Errorf("error replacing journal %s: %w", j.path, err)
+	}
+
+	j.file, err = os.OpenFile(j.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening journal %s: %w", j.path, err)
+	}
+	j.acked = 0
+	return nil
+}
+
+// replayTasks queues the tasks that were left over from the previous run. Single files go
+// through the filters and batching of their watch again, as they may have been held there.
+func replayTasks(tasks []*Task, config *Config) {
+	for _, task := range tasks {
+		if findWatchByID(task.WatchID, config) == nil {
+			logInfo("Dropping journaled task %s: watch %s no longer exists", task, task.WatchID)
+			journal.recordAck(task)
+			continue
+		}
+		logInfo("Requeuing unfinished task from journal: %s", task)
+		if len(task.Batch) > 0 {
+			enqueueTask(task)
+		} else {
+			enqueueOrBatchTask(task, config)
+		}
+	}
+}
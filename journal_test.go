@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// journalLines returns the operations recorded in a journal file, e.g. "enqueue a".
+func journalLines(t *testing.T, path string) []string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record journalRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("unreadable journal line %q: %v", scanner.Text(), err)
+		}
+		id := record.ID
+		if record.Task != nil {
+			id = record.Task.ID
+		}
+		lines = append(lines, record.Op+" "+id)
+	}
+	return lines
+}
+
+func taskIDs(tasks []*Task) []string {
+	var ids []string
+	for _, task := range tasks {
+		ids = append(ids, task.ID)
+	}
+	return ids
+}
+
+func TestJournalReplay(t *testing.T) {
+	tests := []struct {
+		name    string
+		records []string
+		want    []string
+	}{
+		{"empty", nil, nil},
+		{"unacknowledged tasks in queue order", []string{
+			`{"op":"enqueue","task":{"id":"b","path":"/in/b","event":"create","watch_id":"w"}}`,
+			`{"op":"enqueue","task":{"id":"a","path":"/in/a","event":"create","watch_id":"w"}}`,
+		}, []string{"b", "a"}},
+		{"acknowledged tasks are dropped", []string{
+			`{"op":"enqueue","task":{"id":"a","path":"/in/a","event":"create","watch_id":"w"}}`,
+			`{"op":"enqueue","task":{"id":"b","path":"/in/b","event":"create","watch_id":"w"}}`,
+			`{"op":"ack","id":"a"}`,
+		}, []string{"b"}},
+		{"ack of an unknown task", []string{
+			`{"op":"ack","id":"x"}`,
+			`{"op":"enqueue","task":{"id":"a","path":"/in/a","event":"create","watch_id":"w"}}`,
+		}, []string{"a"}},
+		{"record cut short by a crash", []string{
+			`{"op":"enqueue","task":{"id":"a","path":"/in/a","event":"create","watch_id":"w"}}`,
+			`{"op":"ack","id":"a"}`,
+			`{"op":"enqueue","task":{"id":"b","pa`,
+		}, nil},
+		{"enqueue without a task", []string{`{"op":"enqueue"}`}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "journal.jsonl")
+			if tt.records != nil {
+				if err := os.WriteFile(path, []byte(strings.Join(tt.records, "\n")+"\n"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			j, tasks, err := openJournal(path, 0)
+			if err != nil {
+				t.Fatalf("openJournal: %v", err)
+			}
+			defer j.file.Close()
+			if got := taskIDs(tasks); !slices.Equal(got, tt.want) {
+				t.Errorf("replayed tasks = %q, want %q", got, tt.want)
+			}
+
+			// Opening compacts the file down to the replayed tasks
+			var wantLines []string
+			for _, id := range tt.want {
+				wantLines = append(wantLines, "enqueue "+id)
+			}
+			if got := journalLines(t, path); !slices.Equal(got, wantLines) {
+				t.Errorf("journal after opening = %q, want %q", got, wantLines)
+			}
+		})
+	}
+}
+
+func TestJournalCompaction(t *testing.T) {
+	tests := []struct {
+		name         string
+		compactAfter int
+		enqueue      []string
+		ack          []string
+		want         []string
+	}{
+		{"not compacted", 0, []string{"a", "b", "c"}, []string{"a", "b"}, []string{"enqueue a", "enqueue b", "enqueue c", "ack a", "ack b"}},
+		{"below the threshold", 3, []string{"a", "b", "c"}, []string{"a", "b"}, []string{"enqueue a", "enqueue b", "enqueue c", "ack a", "ack b"}},
+		{"at the threshold", 2, []string{"a", "b", "c"}, []string{"a", "b"}, []string{"enqueue c"}},
+		{"counting starts again after compacting", 1, []string{"a", "b", "c"}, []string{"b", "a"}, []string{"enqueue c"}},
+		{"acks of unknown tasks don't count", 1, []string{"a"}, []string{"x"}, []string{"enqueue a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "journal.jsonl")
+			j, _, err := openJournal(path, tt.compactAfter)
+			if err != nil {
+				t.Fatalf("openJournal: %v", err)
+			}
+			for _, id := range tt.enqueue {
+				j.recordEnqueue(&Task{ID: id, Path: "/in/" + id, Event: CreateEvent, WatchID: "w"})
+			}
+			for _, id := range tt.ack {
+				j.recordAck(&Task{ID: id})
+			}
+			j.file.Close()
+
+			if got := journalLines(t, path); !slices.Equal(got, tt.want) {
+				t.Errorf("journal = %q, want %q", got, tt.want)
+			}
+
+			// Whatever was compacted, a restart replays the same tasks
+			reopened, tasks, err := openJournal(path, 0)
+			if err != nil {
+				t.Fatalf("reopening journal: %v", err)
+			}
+			defer reopened.file.Close()
+			var want []string
+			for _, id := range tt.enqueue {
+				if !slices.Contains(tt.ack, id) {
+					want = append(want, id)
+				}
+			}
+			if got := taskIDs(tasks); !slices.Equal(got, want) {
+				t.Errorf("replayed tasks = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestReplayTasks(t *testing.T) {
+	taskQueue = make(chan *Task, 10)
+	defer func() { taskQueue = nil }()
+
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	records := `{"op":"enqueue","task":{"id":"a","path":"/in/a","event":"create","watch_id":"docs"}}
+{"op":"enqueue","task":{"id":"b","path":"/in/b","event":"create","watch_id":"removed"}}
+`
+	if err := os.WriteFile(path, []byte(records), 0644); err != nil {
+		t.Fatal(err)
+	}
+	j, tasks, err := openJournal(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal = j
+	defer func() {
+		journal = nil
+		j.file.Close()
+	}()
+
+	config := &Config{Watches: []Watch{{ID: "docs", TargetPath: "/in"}}}
+	if err := normalizeWatches(config); err != nil {
+		t.Fatal(err)
+	}
+	replayTasks(tasks, config)
+
+	if len(taskQueue) != 1 {
+		t.Fatalf("%d tasks were requeued, want 1", len(taskQueue))
+	}
+	if task := <-taskQueue; task.ID != "a" || task.Path != "/in/a" {
+		t.Errorf("requeued %s, want task a", task)
+	}
+	if !journal.isPending("/in/a") {
+		t.Error("requeued task is no longer pending in the journal")
+	}
+	if journal.isPending("/in/b") {
+		t.Error("task of a removed watch is still pending in the journal")
+	}
+}
+
+func TestJournalHeldAndBatchedFiles(t *testing.T) {
+	taskQueue = make(chan *Task, 10)
+	defer func() { taskQueue = nil }()
+
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	j, _, err := openJournal(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal = j
+	defer func() { journal = nil }()
+	pendingIDs := func() []string {
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		return taskIDs(j.pendingTasks())
+	}
+
+	root := t.TempDir()
+	entry := Watch{ID: "docs", TargetPath: root}
+	entry.MinAge = 1
+	entry.Batch = BatchOptions{Size: 2, Wait: 60000}
+	config := &Config{Watches: []Watch{entry}}
+	if err := normalizeWatches(config); err != nil {
+		t.Fatal(err)
+	}
+	watch := &config.Watches[0]
+	a, b := filepath.Join(root, "a.txt"), filepath.Join(root, "b.txt")
+	os.WriteFile(a, []byte("a"), 0644)
+	os.WriteFile(b, []byte("b"), 0644)
+
+	// Files held for min_age are journaled, a later event replaces the held task
+	enqueueOrBatchTask(newTask(watch, a, CreateEvent), config)
+	enqueueOrBatchTask(newTask(watch, a, WriteEvent), config)
+	enqueueOrBatchTask(newTask(watch, b, CreateEvent), config)
+	if got := pendingIDs(); len(got) != 2 || !j.isPending(a) || !j.isPending(b) {
+		t.Errorf("pending while held: %q", got)
+	}
+
+	// Once old enough, both go to one batch, which takes their place in the journal
+	batch := receiveBatch(t, 3*time.Second)
+	if got := pendingIDs(); !slices.Equal(got, []string{batch.ID}) {
+		t.Errorf("pending after the batch was queued: %q, want only %s", got, batch.ID)
+	}
+	j.file.Close()
+	reopened, tasks, err := openJournal(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened.file.Close()
+	if len(tasks) != 1 || tasks[0].ID != batch.ID || len(tasks[0].Batch) != 2 {
+		t.Errorf("replayed %q, want the batch %s", taskIDs(tasks), batch.ID)
+	}
+
+	// A batch replaces its files even when their acks were lost
+	records := `{"op":"enqueue","task":{"id":"m1","path":"/in/m1","event":"create","watch_id":"docs"}}
+{"op":"enqueue","task":{"id":"m2","path":"/in/m2","event":"create","watch_id":"docs"}}
+{"op":"enqueue","task":{"id":"batch","path":"/in/m1","event":"create","watch_id":"docs","batch":[{"id":"m1","path":"/in/m1"},{"id":"m2","path":"/in/m2"}]}}
+`
+	if err := os.WriteFile(path, []byte(records), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reopened, tasks, err = openJournal(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened.file.Close()
+	if got := taskIDs(tasks); !slices.Equal(got, []string{"batch"}) {
+		t.Errorf("replayed %q, want only the batch", got)
+	}
+}
@@ -7,8 +7,39 @@ import (
 	"path/filepath"
 )
 
+// Constants for log_level values.
+const (
+	LogLevelInfo  = "info"  // Log everything
+	LogLevelError = "error" // Only log messages about errors and failures
+	LogLevelNone  = "none"  // Log nothing
+)
+
+var logLevel = LogLevelInfo // Set from log_level by initLogging
+
+// logInfo logs a message about normal operation, which is only shown at log level info.
+func logInfo(format string, args ...interface{}) {
+	if logLevel == LogLevelInfo {
+		logger.Printf(format, args...)
+	}
+}
+
+// logError logs a message about an error or failure, which is shown unless the log level
+// is none.
+func logError(format string, args ...interface{}) {
+	if logLevel != LogLevelNone {
+		logger.Printf(format, args...)
+	}
+}
+
+// logFatal logs an error like logError and exits.
+func logFatal(format string, args ...interface{}) {
+	logError(format, args...)
+	os.Exit(1)
+}
+
 // initLogging initializes the logger based on configuration.
 func initLogging(config *Config) {
+	logLevel = config.LogLevel
 	if config.EnableLog {
 		if err := initFileLogger(config.LogPath); err != nil {
 			log.Fatalf("Error initializing logger: %v", err)
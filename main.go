@@ -1,6 +1,9 @@
 package main
 
 import (
+	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"os"
 	"reflect"
@@ -14,22 +17,63 @@ import (
 var logger *log.Logger
 var watcherChannel chan notify.EventInfo
 var watcherMutex sync.Mutex
-var taskQueue chan string         // Now a global variable
+var configReloadMutex sync.Mutex // Serializes periodic and requested config reloads
+var taskQueue chan *Task         // Now a global variable
 var workerWg *sync.WaitGroup // Also made global
+var watchQueues map[string]chan *Task // Task queues of watches with a dedicated worker pool
+var taskLanes []chan *Task // Per-worker queues of the shared pool for partitioned tasks
+var watchLanes map[string][]chan *Task // Per-worker queues of the dedicated pools
+var journal *taskJournal               // Persistent record of queued tasks, nil if disabled
+var stateDB *stateStore                // Record of processed files, nil if disabled
 
 func main() {
-	// 1. Load Configuration
-	config, err := loadConfig("config.yaml")
+	// 1. Parse Flags and Load Configuration
+	args, err := parseOptions(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	// Other commands than run talk to the state store or the running instance instead
+	if len(args) > 0 && args[0] == "ctl" {
+		// "ctl status" is the same as "status", and so is "ctl" alone
+		if args = args[1:]; len(args) == 0 {
+			args = []string{"status"}
+		}
+	}
+	isCommand := len(args) > 0 && args[0] != "run"
+
+	// Only run creates a missing config file, commands use the defaults
+	config, err := loadConfig(configPath, !isCommand)
 	if err != nil {
 		log.Fatalf("Error loading config: %v", err)
 	}
 
+	if isCommand {
+		// Commands print their answer to standard output, so their log goes to standard error
+		logLevel = config.LogLevel
+		logger = log.New(os.Stderr, "", log.LstdFlags)
+		os.Exit(runCommand(config, args))
+	}
+
 	// 2. Initialize Logger
 	initLogging(config)
+	logInfo("Using configuration file %s", configPath)
+
+	// 2a. Open the processed file state store
+	if config.StatePath != "" {
+		if stateDB, err = openStateStore(config); err != nil {
+			logFatal("Error opening state store: %v", err)
+		}
+	}
 
-	// 3. Create TargetPath if it doesn't exist
-	if err := os.MkdirAll(config.TargetPath, 0755); err != nil {
-		logger.Fatalf("Error creating target directory %s: %v", config.TargetPath, err)
+	// 3. Create every watch TargetPath if it doesn't exist
+	for _, watch := range config.Watches {
+		if err := os.MkdirAll(watch.TargetPath, 0755); err != nil {
+			logFatal("Error creating target directory %s: %v", watch.TargetPath, err)
+		}
 	}
 
 	// 4. Execute Initialization Command
@@ -38,9 +82,11 @@ func main() {
 	// 5. Set Up Signal Handling
 	setupSignalHandling(config)
 
-	// 6. Watcher Initialization
+	// 6. Watcher Initialization, not needed to process the existing files once
 	watcherChannel = make(chan notify.EventInfo, 100)
-	initializeWatcher(config)
+	if !runOnce {
+		initializeWatcher(config)
+	}
 	defer func() {
 		watcherMutex.Lock()
 		defer watcherMutex.Unlock()
@@ -52,14 +98,41 @@ func main() {
 	// 7. Worker Pool Setup
 	taskQueue, workerWg = setupWorkerPool(config) // Initialized here
 
+	// 7a. Requeue tasks left unfinished by the previous run
+	if config.JournalPath != "" {
+		var replayed []*Task
+		journal, replayed, err = openJournal(config.JournalPath, config.JournalCompact)
+		if err != nil {
+			logFatal("Error opening task journal: %v", err)
+		}
+		if runOnce {
+			replayTasks(replayed, config) // Queued before waiting for the queue to drain
+		} else {
+			go replayTasks(replayed, config)
+		}
+	}
+
+	// 7b. Serve metrics and health checks if an HTTP listener is configured
+	startHTTPServer(config)
+
+	// 7c. Serve the admin API if a socket or address is configured
+	startAdminServer(config)
+
 	// 8. Process Existing Files (if enabled)
-	if config.ProcessOnStart {
-		processExistingFiles(config, taskQueue)
+	if config.ProcessOnStart || runOnce {
+		processExistingFiles(config)
+	}
+
+	// 8a. With --once, exit as soon as they are done
+	if runOnce {
+		os.Exit(finishOnce(config))
 	}
 
 	// 9. Event Handling
-	logger.Println("Watching for file changes in:", config.TargetPath)
-	go handleEvents(watcherChannel, taskQueue, config)
+	for _, watch := range config.Watches {
+		logInfo("Watching for file changes in: %s (watch %s)", watch.TargetPath, watch.ID)
+	}
+	go handleEvents(watcherChannel, config)
 
 	// 10. Config Reloading
 	if config.ReloadConfig > 0 {
@@ -73,59 +146,110 @@ func main() {
 	<-make(chan struct{})
 
 	// 13. Clean Up
-	close(taskQueue)
+	closeTaskQueues()
 	workerWg.Wait()
 }
 
 func periodicConfigReload(config *Config) {
-	logger.Println("Configuration is set to reload every ", config.ReloadConfig, " miliseconds")
+	logInfo("Configuration is set to reload every %d miliseconds", config.ReloadConfig)
 	ticker := time.NewTicker(time.Duration(config.ReloadConfig) * time.Millisecond)
 	defer ticker.Stop()
 
-	// Store the initial configuration values
-	oldConfigValues := make(map[string]interface{})
-	configVal := reflect.ValueOf(config).Elem()
-	configType := configVal.Type()
-	for i := 0; i < configVal.NumField(); i++ {
-		field := configType.Field(i)
-		value := configVal.Field(i).Interface()
-		oldConfigValues[field.Name] = value
-	}
-
 	for range ticker.C {
-		newConfig, err := loadConfig("config.yaml")
-		if err != nil {
-			logger.Fatalf("Error reloading config: %v", err)
+		interval := config.ReloadConfig
+		if err := reloadConfig(config); err != nil {
+			logError("Error reloading config: %v", err)
 			continue
 		}
 
-		// Compare old and new values and log changes
-		newConfigVal := reflect.ValueOf(newConfig).Elem()
-		for i := 0; i < newConfigVal.NumField(); i++ {
-			fieldName := configType.Field(i).Name
-			newValue := newConfigVal.Field(i).Interface()
-			oldValue := oldConfigValues[fieldName]
-
-			if !reflect.DeepEqual(oldValue, newValue) {
-				logger.Printf("Config change detected - %s: %v -> %v", fieldName, oldValue, newValue)
-				oldConfigValues[fieldName] = newValue // Update old value
+		// Update ticker if ReloadConfig changed
+		if config.ReloadConfig != interval {
+			if config.ReloadConfig <= 0 {
+				logInfo("Configuration reloading disabled.")
+				return
 			}
+			ticker.Reset(time.Duration(config.ReloadConfig) * time.Millisecond)
 		}
+	}
+}
 
-		// Update the global config variable
-		*config = *newConfig
+// reloadConfig loads the configuration file again and applies it to config, logging what
+// changed. The previous configuration stays active if the file can't be loaded.
+func reloadConfig(config *Config) error {
+	configReloadMutex.Lock()
+	defer configReloadMutex.Unlock()
 
-		// Update ticker if ReloadConfig changed
-		if config.ReloadConfig != newConfig.ReloadConfig {
-			ticker.Stop()
-			ticker = time.NewTicker(time.Duration(newConfig.ReloadConfig) * time.Millisecond)
+	newConfig, err := loadConfig(configPath, true)
+	if err == nil {
+		err = checkWorkerPools(config, newConfig)
+	}
+	if err != nil {
+		metricConfigReloads.inc("error")
+		return err
+	}
+	metricConfigReloads.inc("ok")
+
+	// Compare old and new values and log changes
+	oldConfigVal := reflect.ValueOf(config).Elem()
+	newConfigVal := reflect.ValueOf(newConfig).Elem()
+	configType := newConfigVal.Type()
+	for i := 0; i < newConfigVal.NumField(); i++ {
+		oldValue := oldConfigVal.Field(i).Interface()
+		newValue := newConfigVal.Field(i).Interface()
+		if !reflect.DeepEqual(oldValue, newValue) {
+			logInfo("Config change detected - %s: %v -> %v", configType.Field(i).Name, oldValue, newValue)
+		}
+	}
+
+	// Re-register the watcher if the set of watched roots changed
+	rootsChanged := !sameWatchRoots(config, newConfig)
+
+	// Update the global config variable
+	*config = *newConfig
+
+	if rootsChanged {
+		logInfo("Watched directories changed. Reinitializing watcher.")
+		reinitializeWatcher(config)
+	}
+	return nil
+}
+
+// finishOnce waits until every queued file is processed, stops the workers and runs
+// exit_run. It returns the exit code: 1 if any task failed, 0 otherwise.
+func finishOnce(config *Config) int {
+	for !isIdle() {
+		time.Sleep(100 * time.Millisecond)
+	}
+	removeAdminSocket() // No more requests once the queues are closed
+	closeTaskQueues()
+	workerWg.Wait()
+	stateDB.flush()
+	executeShutdownCommand(config)
+
+	if failed := failedTasks.Load(); failed > 0 {
+		logError("Processed the existing files, %d tasks failed", failed)
+		return 1
+	}
+	logInfo("Processed the existing files")
+	return 0
+}
+
+// sameWatchRoots reports whether both configurations watch the same directories.
+func sameWatchRoots(a, b *Config) bool {
+	if len(a.Watches) != len(b.Watches) {
+		return false
+	}
+	for i := range a.Watches {
+		if a.Watches[i].root != b.Watches[i].root {
+			return false
 		}
 	}
+	return true
 }
 
-// isTargetAccessible checks if the target path is accessible.
-func isTargetAccessible(config *Config) bool {
-	_, err := os.Stat(config.TargetPath)
+// isTargetAccessible checks if the target path of a watch is accessible.
+func isTargetAccessible(watch *Watch) bool {
+	_, err := os.Stat(watch.TargetPath)
 	return err == nil
 }
 
@@ -140,53 +264,39 @@ func reinitializeWatcher(config *Config) {
 
 	watcherChannel = make(chan notify.EventInfo, 100)
 	initializeWatcher(config)
-	go handleEvents(watcherChannel, taskQueue, config) // Now taskQueue is accessible
-	logger.Println("Watcher reinitialized successfully.")
+	go handleEvents(watcherChannel, config)
+	metricWatcherReinits.inc()
+	logInfo("Watcher reinitialized successfully.")
 }
 
-// periodicWatcherRecovery periodically checks the accessibility of the target path and reinitializes the watcher if necessary.
+// periodicWatcherRecovery periodically checks the accessibility of every target path and
+// reinitializes the watcher whenever a target goes away or comes back.
 func periodicWatcherRecovery(config *Config) {
-	logger.Println("Watcher recovery routine started. Checking accessibility every", config.CheckInterval, "seconds")
+	logInfo("Watcher recovery routine started. Checking accessibility every %d seconds", config.CheckInterval)
 	ticker := time.NewTicker(time.Duration(config.CheckInterval) * time.Second)
 	defer ticker.Stop()
 
+	inaccessible := make(map[string]bool)
 	for range ticker.C {
-		if !isTargetAccessible(config) {
-			logger.Printf("Target path %s is inaccessible. Stopping watcher.", config.TargetPath)
-
-			watcherMutex.Lock()
-			if watcherChannel != nil {
-				notify.Stop(watcherChannel)
-				watcherChannel = nil
-			}
-			watcherMutex.Unlock()
-
-			// Keep checking for accessibility until it's restored
-			for !isTargetAccessible(config) {
-				time.Sleep(time.Duration(config.CheckInterval) * time.Second)
+		changed := false
+		for i := range config.Watches {
+			watch := &config.Watches[i]
+			accessible := isTargetAccessible(watch)
+			if !accessible && !inaccessible[watch.ID] {
+				logError("Target path %s is inaccessible. Stopping watcher.", watch.TargetPath)
+				inaccessible[watch.ID] = true
+				changed = true
+			} else if accessible && inaccessible[watch.ID] {
+				logInfo("Target path %s is accessible again. Reinitializing watcher.", watch.TargetPath)
+				delete(inaccessible, watch.ID)
+				changed = true
 			}
-
-			logger.Printf("Target path %s is accessible again. Reinitializing watcher.", config.TargetPath)
-			reinitializeWatcher(config)
 		}
-	}
-}
 
-/*
-func periodicConfigReload_old(config *Config) {
-	logger.Println("Configuration is set to reload every ", config.ReloadConfig, " miliseconds")
-	ticker := time.NewTicker(time.Duration(config.ReloadConfig) * time.Millisecond)
-	defer ticker.Stop()
-
-	for range ticker.C {
-		newConfig, err := loadConfig("config.yaml")
-		if err != nil {
-			logger.Printf("Error reloading config: %v", err)
-			continue
+		// Watches that are still accessible keep running; the inaccessible ones are
+		// skipped by initializeWatcher until they come back.
+		if changed {
+			reinitializeWatcher(config)
 		}
-
-		// Update the global config variable
-		*config = *newConfig
 	}
 }
-*/
\ No newline at end of file
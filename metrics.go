@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics exposed on /metrics in the Prometheus text format.
+var (
+	metricEvents = newCounterVec("wtd_events_total",
+		"File system events received, by watch and event type.", "watch", "event")
+	metricDebounced = newCounterVec("wtd_events_debounced_total",
+		"Events dropped or merged by debouncing.", "mode")
+	metricSkipped = newCounterVec("wtd_files_skipped_total",
+		"Files not processed, by watch and reason (excluded, filtered, unchanged, identical, paused).", "watch", "reason")
+	metricCommandDuration = newHistogramVec("wtd_command_duration_seconds",
+		"Duration of command runs, by watch.",
+		[]float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300, 900}, "watch")
+	metricCommandExits = newCounterVec("wtd_command_exits_total",
+		"Command runs by watch and exit code; -1 means the command could not be started or was killed.", "watch", "exit_code")
+	metricCommandTimeouts = newCounterVec("wtd_command_timeouts_total",
+		"Commands killed because they exceeded their timeout.", "watch")
+	metricPostProcess = newCounterVec("wtd_post_process_total",
+		"Post-processing outcomes, by watch, action (none, move, delete, failed) and result (ok, error).", "watch", "action", "result")
+	metricWatcherReinits = newCounterVec("wtd_watcher_reinitializations_total",
+		"Times the file system watcher was set up again.")
+	metricConfigReloads = newCounterVec("wtd_config_reloads_total",
+		"Configuration reloads, by result (ok, error).", "result")
+
+	totalWorkers atomic.Int64 // Workers that are running
+)
+
+// metricsRegistry lists everything written on /metrics, in order.
+var metricsRegistry = []metricWriter{
+	metricEvents, metricDebounced, metricSkipped,
+	metricCommandDuration, metricCommandExits, metricCommandTimeouts,
+	metricPostProcess, metricWatcherReinits, metricConfigReloads,
+	gaugeFunc{"wtd_queue_depth", "Tasks waiting in the queue of each worker pool.", queueDepths},
+	gaugeFunc{"wtd_workers_busy", "Workers currently processing a task.", func() map[string]float64 {
+		return map[string]float64{"": float64(busyWorkerCount())}
+	}},
+	gaugeFunc{"wtd_workers", "Number of workers.", func() map[string]float64 {
+		return map[string]float64{"": float64(totalWorkers.Load())}
+	}},
+}
+
+// metricWriter is a metric that can write itself in the Prometheus text format.
+type metricWriter interface {
+	writeTo(w io.Writer)
+}
+
+// counterVec is a counter with labels.
+type counterVec struct {
+	mu     sync.Mutex
+	name   string
+	help   string
+	labels []string
+	values map[string]float64 // By label values joined with labelSeparator
+}
+
+// labelSeparator joins label values into map keys; it can't appear in valid UTF-8.
+const labelSeparator = "\xff"
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+// inc adds one to the counter with the given label values.
+func (c *counterVec) inc(labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[strings.Join(labelValues, labelSeparator)]++
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	if len(c.labels) == 0 && len(c.values) == 0 {
+		fmt.Fprintf(w, "%s 0\n", c.name)
+	}
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, key, "", ""), formatValue(c.values[key]))
+	}
+}
+
+// histogramVec is a histogram with labels.
+type histogramVec struct {
+	mu      sync.Mutex
+	name    string
+	help    string
+	buckets []float64
+	labels  []string
+	series  map[string]*histogram
+}
+
+// histogram holds the observations of one label combination.
+type histogram struct {
+	counts []uint64 // Per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, buckets: buckets, labels: labels, series: make(map[string]*histogram)}
+}
+
+// observe records a value for the given label values.
+func (h *histogramVec) observe(value float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := strings.Join(labelValues, labelSeparator)
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			s.counts[i]++
+			break
+		}
+	}
+	s.count++
+	s.sum += value
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", formatValue(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, key, "", ""), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, key, "", ""), s.count)
+	}
+}
+
+// gaugeFunc is a gauge whose values are computed when /metrics is requested. The function
+// returns the values by the value of the label "pool", or by "" for a gauge without labels.
+type gaugeFunc struct {
+	name  string
+	help  string
+	value func() map[string]float64
+}
+
+func (g gaugeFunc) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	values := g.value()
+	for _, key := range sortedKeys(values) {
+		labels := ""
+		if key != "" {
+			labels = formatLabels([]string{"pool"}, key, "", "")
+		}
+		fmt.Fprintf(w, "%s%s %s\n", g.name, labels, formatValue(values[key]))
+	}
+}
+
+// queueDepths returns the number of queued tasks of the shared pool and of every
+// dedicated pool, including their lanes.
+func queueDepths() map[string]float64 {
+	depths := map[string]float64{"shared": float64(len(taskQueue))}
+	for _, lane := range taskLanes {
+		depths["shared"] += float64(len(lane))
+	}
+	for id, queue := range watchQueues {
+		depths[id] = float64(len(queue))
+		for _, lane := range watchLanes[id] {
+			depths[id] += float64(len(lane))
+		}
+	}
+	return depths
+}
+
+// labelEscaper escapes label values for the Prometheus text format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels formats the label set of a series, adding an extra label if extraName is set.
+func formatLabels(names []string, key, extraName, extraValue string) string {
+	var pairs []string
+	if len(names) > 0 {
+		for i, value := range strings.Split(key, labelSeparator) {
+			if i < len(names) {
+				pairs = append(pairs, names[i]+`="`+labelEscaper.Replace(value)+`"`)
+			}
+		}
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+`="`+labelEscaper.Replace(extraValue)+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// formatValue formats a sample value the way Prometheus expects it.
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// sortedKeys returns the keys of a series map in sorted order.
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// handleMetrics serves every registered metric in the Prometheus text format.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, metric := range metricsRegistry {
+		metric.writeTo(w)
+	}
+}
+
+// observeCommand records the duration and outcome of a command run.
+func observeCommand(watch *Watch, duration time.Duration, exitCode int, reason string) {
+	metricCommandDuration.observe(duration.Seconds(), watch.ID)
+	metricCommandExits.inc(watch.ID, strconv.Itoa(exitCode))
+	if reason == FailureReasonTimeout {
+		metricCommandTimeouts.inc(watch.ID)
+	}
+}
+
+// observePostProcess records the outcome of moving or deleting a file after processing.
+func observePostProcess(watch *Watch, action string, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	metricPostProcess.inc(watch.ID, action, result)
+}
+
+// postProcessActionName returns the metric label of a post_process_action value.
+func postProcessActionName(action int) string {
+	switch action {
+	case PostProcessActionMove:
+		return "move"
+	case PostProcessActionDelete:
+		return "delete"
+	}
+	return "none"
+}
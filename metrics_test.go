@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCounterVecFormat(t *testing.T) {
+	c := newCounterVec("test_total", "A test counter.", "watch", "event")
+	c.inc("docs", "create")
+	c.inc("docs", "create")
+	c.inc(`we"ird`, "write")
+
+	var b strings.Builder
+	c.writeTo(&b)
+	want := `# HELP test_total A test counter.
+# TYPE test_total counter
+test_total{watch="docs",event="create"} 2
+test_total{watch="we\"ird",event="write"} 1
+`
+	if b.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", b.String(), want)
+	}
+
+	// A counter without labels shows 0 before anything was counted
+	b.Reset()
+	newCounterVec("empty_total", "Nothing yet.").writeTo(&b)
+	if !strings.HasSuffix(b.String(), "\nempty_total 0\n") {
+		t.Errorf("unlabelled counter:\n%s", b.String())
+	}
+}
+
+func TestHistogramVecFormat(t *testing.T) {
+	h := newHistogramVec("test_seconds", "A test histogram.", []float64{0.1, 1}, "watch")
+	h.observe(0.05, "docs")
+	h.observe(0.5, "docs")
+	h.observe(3, "docs")
+
+	var b strings.Builder
+	h.writeTo(&b)
+	want := `# HELP test_seconds A test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{watch="docs",le="0.1"} 1
+test_seconds_bucket{watch="docs",le="1"} 2
+test_seconds_bucket{watch="docs",le="+Inf"} 3
+test_seconds_sum{watch="docs"} 3.55
+test_seconds_count{watch="docs"} 3
+`
+	if b.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+func TestHandleMetrics(t *testing.T) {
+	watch := &Watch{ID: "metrics-test"}
+	observeCommand(watch, 20*time.Millisecond, 0, "")
+	observeCommand(watch, time.Second, -1, FailureReasonTimeout)
+
+	rec := httptest.NewRecorder()
+	handleMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	for _, want := range []string{
+		`wtd_command_exits_total{watch="metrics-test",exit_code="0"} 1`,
+		`wtd_command_exits_total{watch="metrics-test",exit_code="-1"} 1`,
+		`wtd_command_timeouts_total{watch="metrics-test"} 1`,
+		`wtd_command_duration_seconds_count{watch="metrics-test"} 2`,
+		"# TYPE wtd_queue_depth gauge",
+		"# TYPE wtd_workers gauge",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("/metrics does not contain %q", want)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Constants for the kind of value a command-line option takes.
+const (
+	optionString = "string"
+	optionInt    = "int"
+	optionBool   = "bool"
+)
+
+var (
+	configPath      = "config.yaml"                // Configuration file, also used when reloading
+	runOnce         bool                           // Process the existing files and exit instead of watching
+	configOverrides = make(map[string]interface{}) // Settings from flags and environment variables, by config key
+)
+
+// cliOption is a setting that can be given as a command-line flag or an environment
+// variable. A flag takes precedence over the variable, and both over the config file.
+type cliOption struct {
+	flag  string // Flag name without dashes
+	env   string // Environment variable
+	key   string // Config file setting it overrides, "" for options that are not in the config file
+	kind  string // optionString, optionInt or optionBool
+	usage string
+}
+
+// cliOptions lists the options, in the order they are shown in the usage text.
+var cliOptions = []cliOption{
+	{"config", "WTD_CONFIG", "", optionString, "configuration file (default config.yaml)"},
+	{"target", "WTD_TARGET", "target_path", optionString, "directory to watch, when the config has no watches: list"},
+	{"workers", "WTD_WORKERS", "max_workers", optionInt, "number of workers in the shared pool"},
+	{"log-level", "WTD_LOG_LEVEL", "log_level", optionString, "info, error or none"},
+	{"log-file", "WTD_LOG_FILE", "logfile_path", optionString, "write the log to this file instead of standard output"},
+	{"once", "WTD_ONCE", "", optionBool, "process the existing files, then exit"},
+	{"dry-run", "WTD_DRY_RUN", "dry_run", optionBool, "log the commands instead of running them, and leave the files in place"},
+	{"http-listen", "WTD_HTTP_LISTEN", "http_listen", optionString, "address for /metrics, /healthz and /readyz"},
+	{"admin-socket", "WTD_ADMIN_SOCKET", "admin_socket", optionString, "Unix socket of the admin API"},
+}
+
+// parseOptions reads the options from the environment and from the flags before the
+// command, or after "run", and returns the command with its arguments.
+func parseOptions(args []string) ([]string, error) {
+	values := make(map[string]string)
+	for _, opt := range cliOptions {
+		if value, ok := os.LookupEnv(opt.env); ok && value != "" {
+			values[opt.flag] = value
+		}
+	}
+
+	fs := flag.NewFlagSet("WatchThatDir", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(fs.Output(), usage) }
+	for _, opt := range cliOptions {
+		name := opt.flag
+		set := func(value string) error {
+			values[name] = value
+			return nil
+		}
+		if opt.kind == optionBool {
+			fs.BoolFunc(name, opt.usage, set)
+		} else {
+			fs.Func(name, opt.usage, set)
+		}
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	args = fs.Args()
+	if len(args) > 0 && args[0] == "run" {
+		if err := fs.Parse(args[1:]); err != nil {
+			return nil, err
+		}
+		args = append([]string{"run"}, fs.Args()...)
+	}
+
+	for _, opt := range cliOptions {
+		value, ok := values[opt.flag]
+		if !ok {
+			continue
+		}
+		parsed, err := opt.parse(value)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case opt.key != "":
+			configOverrides[opt.key] = parsed
+		case opt.flag == "config":
+			configPath = value
+		case opt.flag == "once":
+			runOnce = parsed.(bool)
+		}
+	}
+	// A log file given on the command line is meant to be written
+	if _, ok := configOverrides["logfile_path"]; ok {
+		configOverrides["enable_logging"] = true
+	}
+	// Reloading must find the same file even if the working directory changes
+	if absPath, err := filepath.Abs(configPath); err == nil {
+		configPath = absPath
+	}
+	return args, nil
+}
+
+// parse converts the value of an option to the type of its setting.
+func (opt cliOption) parse(value string) (interface{}, error) {
+	switch opt.kind {
+	case optionInt:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %q for --%s (%s): not a number", value, opt.flag, opt.env)
+		}
+		return n, nil
+	case optionBool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %q for --%s (%s): not true or false", value, opt.flag, opt.env)
+		}
+		return b, nil
+	}
+	return value, nil
+}
+
+// applyOverrides applies the settings given as flags or environment variables on top
+// of the ones from the config file.
+func applyOverrides(config *Config) error {
+	if len(configOverrides) == 0 {
+		return nil
+	}
+	if _, ok := configOverrides["target_path"]; ok && len(config.Watches) > 0 {
+		return fmt.Errorf("--target (WTD_TARGET) can't be used with a watches: list in the config file")
+	}
+
+	// Going through YAML gives the overrides the same parsing as the config file
+	data, err := yaml.Marshal(configOverrides)
+	if err != nil {
+		return fmt.Errorf("error marshalling command-line settings: %w", err)
+	}
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return fmt.Errorf("error applying command-line settings: %w", err)
+	}
+	return nil
+}
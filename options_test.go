@@ -0,0 +1,183 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+// resetOptions clears the settings parseOptions leaves behind, and every option variable
+// that may be set in the environment the tests run in.
+func resetOptions(t *testing.T) {
+	t.Helper()
+	for _, opt := range cliOptions {
+		t.Setenv(opt.env, "")
+	}
+	savedPath, savedOnce := configPath, runOnce
+	t.Cleanup(func() {
+		configPath, runOnce = savedPath, savedOnce
+		configOverrides = make(map[string]interface{})
+	})
+	configPath, runOnce = "config.yaml", false
+	configOverrides = make(map[string]interface{})
+}
+
+func TestOptionPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.yaml")
+	yaml := "target_path: '" + filepath.ToSlash(filepath.Join(dir, "in")) + "'\nmax_workers: 3\nlog_level: info\n"
+	if err := os.WriteFile(file, []byte(yaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		env         map[string]string
+		args        []string
+		wantArgs    []string
+		wantWorkers int
+		wantLevel   string
+		wantOnce    bool
+	}{
+		{"config file", nil, nil, nil, 3, LogLevelInfo, false},
+		{"environment over config file", map[string]string{"WTD_WORKERS": "4"}, nil, nil, 4, LogLevelInfo, false},
+		{"flag over environment", map[string]string{"WTD_WORKERS": "4"}, []string{"--workers", "6"}, nil, 6, LogLevelInfo, false},
+		{"flags after run", map[string]string{"WTD_LOG_LEVEL": "none"}, []string{"run", "--workers=7", "--log-level", "error"}, []string{"run"}, 7, LogLevelError, false},
+		{"bool flag", map[string]string{"WTD_ONCE": "false"}, []string{"--once"}, nil, 3, LogLevelInfo, true},
+		{"bool environment variable", map[string]string{"WTD_ONCE": "true"}, nil, nil, 3, LogLevelInfo, true},
+		{"command arguments are kept", nil, []string{"--workers", "2", "state", "forget", "a.txt"}, []string{"state", "forget", "a.txt"}, 2, LogLevelInfo, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetOptions(t)
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			t.Setenv("WTD_CONFIG", file)
+
+			args, err := parseOptions(tt.args)
+			if err != nil {
+				t.Fatalf("parseOptions(%q): %v", tt.args, err)
+			}
+			if !slices.Equal(args, tt.wantArgs) {
+				t.Errorf("args = %q, want %q", args, tt.wantArgs)
+			}
+			if configPath != file {
+				t.Errorf("configPath = %s, want %s", configPath, file)
+			}
+			if runOnce != tt.wantOnce {
+				t.Errorf("runOnce = %v, want %v", runOnce, tt.wantOnce)
+			}
+
+			config, err := loadConfig(configPath, true)
+			if err != nil {
+				t.Fatalf("loadConfig: %v", err)
+			}
+			if config.MaxWorkers != tt.wantWorkers {
+				t.Errorf("max_workers = %d, want %d", config.MaxWorkers, tt.wantWorkers)
+			}
+			if config.LogLevel != tt.wantLevel {
+				t.Errorf("log_level = %s, want %s", config.LogLevel, tt.wantLevel)
+			}
+		})
+	}
+}
+
+func TestParseOptionsErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		args []string
+	}{
+		{"invalid number in environment", map[string]string{"WTD_WORKERS": "many"}, nil},
+		{"invalid number in flag", nil, []string{"--workers", "many"}},
+		{"invalid bool", map[string]string{"WTD_DRY_RUN": "maybe"}, nil},
+		{"unknown flag", nil, []string{"--nope"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetOptions(t)
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			if _, err := parseOptions(tt.args); err == nil {
+				t.Errorf("parseOptions(%q) succeeded, want an error", tt.args)
+			}
+		})
+	}
+}
+
+func TestApplyOverrides(t *testing.T) {
+	tests := []struct {
+		name      string
+		overrides map[string]interface{}
+		config    Config
+		want      Config
+		wantErr   bool
+	}{
+		{"nothing to apply", nil, Config{MaxWorkers: 3}, Config{MaxWorkers: 3}, false},
+		{"overrides replace file settings", map[string]interface{}{"max_workers": 8, "dry_run": true}, Config{MaxWorkers: 3}, Config{MaxWorkers: 8, DryRun: true}, false},
+		{"log file enables logging", map[string]interface{}{"logfile_path": "x.log", "enable_logging": true}, Config{}, Config{LogPath: "x.log", EnableLog: true}, false},
+		{"target with watches", map[string]interface{}{"target_path": "in"}, Config{Watches: []Watch{{ID: "a"}}}, Config{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetOptions(t)
+			for key, value := range tt.overrides {
+				configOverrides[key] = value
+			}
+			config := tt.config
+			err := applyOverrides(&config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("applyOverrides() = %v, want error: %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(config, tt.want) {
+				t.Errorf("config = %+v, want %+v", config, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigValidatesOverrides(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(existing, []byte("max_workers: 3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range []string{existing, filepath.Join(dir, "missing.yaml")} {
+		resetOptions(t)
+		t.Setenv("WTD_LOG_LEVEL", "loud")
+		if _, err := parseOptions(nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadConfig(file, true); err == nil {
+			t.Errorf("loadConfig(%s) accepted log_level loud", filepath.Base(file))
+		}
+	}
+}
+
+func TestLoadConfigMissingFile(t *testing.T) {
+	resetOptions(t)
+	file := filepath.Join(t.TempDir(), "config.yaml")
+
+	config, err := loadConfig(file, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.MaxWorkers != 1 || len(config.Watches) != 1 {
+		t.Errorf("defaults not applied: max_workers %d, %d watches", config.MaxWorkers, len(config.Watches))
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("config file created without create: %v", err)
+	}
+
+	if _, err := loadConfig(file, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("config file not created: %v", err)
+	}
+}
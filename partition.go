@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Constants for partition_by values. A value starting with "re:" is a regular expression.
+const (
+	PartitionByDirectory = "directory"  // Files in the same folder are processed in order
+	PartitionByTopFolder = "top_folder" // Files below the same folder of target_path are processed in order
+)
+
+// compilePartition checks the partition_by setting of a watch and compiles its regular expression.
+func compilePartition(watch *Watch) error {
+	switch {
+	case watch.PartitionBy == "", watch.PartitionBy == PartitionByDirectory, watch.PartitionBy == PartitionByTopFolder:
+		return nil
+	case strings.HasPrefix(watch.PartitionBy, regexPatternPrefix):
+		re, err := regexp.Compile(strings.TrimPrefix(watch.PartitionBy, regexPatternPrefix))
+		if err != nil {
+			return fmt.Errorf("invalid partition_by regular expression: %w", err)
+		}
+		watch.partitionRe = re
+		return nil
+	}
+	return fmt.Errorf("invalid partition_by value: %s", watch.PartitionBy)
+}
+
+// partitionKey returns the key that decides which tasks of a watch are processed in order,
+// or "" if the file is not partitioned.
+func partitionKey(watch *Watch, filePath string) string {
+	relPath := relativeToRoot(filePath, watch)
+
+	var key string
+	switch {
+	case watch.PartitionBy == PartitionByDirectory:
+		key = path.Dir(relPath)
+	case watch.PartitionBy == PartitionByTopFolder:
+		key, _, _ = strings.Cut(relPath, "/")
+		if key == relPath {
+			key = "." // Files directly in target_path share one lane
+		}
+	case watch.partitionRe != nil:
+		match := watch.partitionRe.FindStringSubmatch(relPath)
+		if match == nil {
+			return ""
+		}
+		key = match[0]
+		if len(match) > 1 {
+			key = strings.Join(match[1:], "/") // The capture groups, if there are any
+		}
+	default:
+		return ""
+	}
+	return watch.ID + ":" + key
+}
+
+// laneFor picks the lane of a partition key. The same key always maps to the same lane.
+func laneFor(key string, lanes []chan *Task) chan *Task {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return lanes[h.Sum32()%uint32(len(lanes))]
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestPartitionKey(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "in")
+
+	tests := []struct {
+		partitionBy string
+		path        string
+		want        string
+	}{
+		{"", "a/b.txt", ""},
+		{PartitionByDirectory, "a/b/c.txt", "w:a/b"},
+		{PartitionByDirectory, "c.txt", "w:."},
+		{PartitionByTopFolder, "a/b/c.txt", "w:a"},
+		{PartitionByTopFolder, "c.txt", "w:."},
+		{`re:^customer-\d+`, "customer-12/orders/1.csv", "w:customer-12"},
+		{`re:^(\w+)/(\d{4})/`, "eu/2024/x.csv", "w:eu/2024"},
+		{`re:^customer-\d+`, "other/1.csv", ""},
+	}
+	for _, tt := range tests {
+		watch := &Watch{ID: "w", root: root}
+		watch.PartitionBy = tt.partitionBy
+		if err := compilePartition(watch); err != nil {
+			t.Fatalf("compilePartition(%q): %v", tt.partitionBy, err)
+		}
+		path := filepath.Join(root, filepath.FromSlash(tt.path))
+		if got := partitionKey(watch, path); got != tt.want {
+			t.Errorf("partitionKey(%q, %s) = %q, want %q", tt.partitionBy, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestCompilePartitionErrors(t *testing.T) {
+	for _, partitionBy := range []string{"folder", "re:(unclosed"} {
+		watch := &Watch{}
+		watch.PartitionBy = partitionBy
+		if err := compilePartition(watch); err == nil {
+			t.Errorf("compilePartition(%q) succeeded, want an error", partitionBy)
+		}
+	}
+}
+
+func TestEnqueueTaskKeepsPartitionsOnOneLane(t *testing.T) {
+	taskQueue = make(chan *Task, 10)
+	taskLanes = []chan *Task{make(chan *Task, 10), make(chan *Task, 10), make(chan *Task, 10)}
+	defer func() { taskQueue, taskLanes = nil, nil }()
+
+	for i := 0; i < 5; i++ {
+		enqueueTask(&Task{ID: fmt.Sprint(i), Path: "/in/customer-1/file.csv", Partition: "w:customer-1"})
+	}
+	enqueueTask(&Task{ID: "unpartitioned", Path: "/in/other.csv"})
+
+	lane := laneFor("w:customer-1", taskLanes)
+	if len(lane) != 5 {
+		t.Fatalf("%d of 5 tasks of the partition are on its lane", len(lane))
+	}
+	for i := 0; i < 5; i++ {
+		if task := <-lane; task.ID != fmt.Sprint(i) {
+			t.Errorf("task %s came out of the lane at position %d", task.ID, i)
+		}
+	}
+	if len(taskQueue) != 1 {
+		t.Errorf("unpartitioned task is not on the shared queue")
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+)
+
+// regexPatternPrefix marks an include_path or exclude_path entry as a regular expression.
+const regexPatternPrefix = "re:"
+
+// pathPattern is a single compiled include_path or exclude_path entry.
+type pathPattern struct {
+	raw      string
+	negate   bool           // "!pattern" re-includes paths matched by an earlier pattern
+	glob     string         // doublestar pattern in slash form, empty for regular expressions
+	absolute bool           // The glob is matched against the absolute path instead of the relative one
+	re       *regexp.Regexp // Matched against the path relative to the watch root
+}
+
+// pathMatcher matches paths against an ordered list of patterns. Like in .gitignore,
+// the last pattern that matches a path decides the result.
+type pathMatcher struct {
+	patterns      []pathPattern
+	caseSensitive bool
+	hasNegation   bool
+}
+
+// defaultCaseSensitive reports whether paths are compared case-sensitively when
+// case_sensitive is not configured: yes, except on Windows and macOS.
+func defaultCaseSensitive() bool {
+	return runtime.GOOS != "windows" && runtime.GOOS != "darwin"
+}
+
+// compilePathPatterns compiles a list of include_path or exclude_path entries.
+// It returns nil for an empty list.
+func compilePathPatterns(patterns []string, caseSensitive bool) (*pathMatcher, error) {
+	m := &pathMatcher{caseSensitive: caseSensitive}
+	for _, raw := range patterns {
+		pattern := strings.TrimSpace(raw)
+		if pattern == "" {
+			continue
+		}
+
+		p := pathPattern{raw: raw}
+		if strings.HasPrefix(pattern, "!") {
+			p.negate = true
+			m.hasNegation = true
+			pattern = pattern[1:]
+		}
+
+		if strings.HasPrefix(pattern, regexPatternPrefix) {
+			expr := strings.TrimPrefix(pattern, regexPatternPrefix)
+			if !caseSensitive {
+				expr = "(?i)" + expr
+			}
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid regular expression %q: %w", raw, err)
+			}
+			p.re = re
+		} else {
+			p.absolute = filepath.IsAbs(pattern) || strings.HasPrefix(pattern, "/")
+			glob := pattern
+			if runtime.GOOS == "windows" {
+				glob = filepath.ToSlash(glob) // Elsewhere backslashes are glob escapes
+			}
+			glob = strings.TrimSuffix(glob, "/")
+			if !p.absolute && !strings.Contains(glob, "/") {
+				glob = "**/" + glob // A bare name matches at any depth
+			}
+			if !caseSensitive {
+				glob = strings.ToLower(glob)
+			}
+			if !doublestar.ValidatePattern(glob) {
+				return nil, fmt.Errorf("invalid glob pattern %q", raw)
+			}
+			p.glob = glob
+		}
+		m.patterns = append(m.patterns, p)
+	}
+
+	if len(m.patterns) == 0 {
+		return nil, nil
+	}
+	return m, nil
+}
+
+// matches reports whether absPath, which lies below root, is selected by the patterns.
+// A pattern that matches a directory also matches everything inside it. It is always
+// false on a nil matcher.
+func (m *pathMatcher) matches(absPath, root string) bool {
+	if m == nil {
+		return false
+	}
+	relPath, err := filepath.Rel(root, absPath)
+	if err != nil || relPath == "." {
+		return false
+	}
+	relPath = filepath.ToSlash(relPath)
+	rootPrefix := strings.TrimSuffix(filepath.ToSlash(root), "/") + "/"
+
+	// The path itself and every directory above it, up to the root
+	candidates := []string{relPath}
+	for dir := relPath; strings.Contains(dir, "/"); {
+		dir = dir[:strings.LastIndex(dir, "/")]
+		candidates = append(candidates, dir)
+	}
+
+	matched := false
+	for _, p := range m.patterns {
+		for _, candidate := range candidates {
+			if p.matchesCandidate(candidate, rootPrefix, m.caseSensitive) {
+				matched = !p.negate
+				break
+			}
+		}
+	}
+	return matched
+}
+
+// canIncludeAgain reports whether a "!" pattern may select paths below a matched directory.
+// It is false on a nil matcher.
+func (m *pathMatcher) canIncludeAgain() bool {
+	return m != nil && m.hasNegation
+}
+
+// matchesCandidate matches a single pattern against a path relative to the root.
+func (p *pathPattern) matchesCandidate(relPath, rootPrefix string, caseSensitive bool) bool {
+	if p.re != nil {
+		return p.re.MatchString(relPath)
+	}
+
+	subject := relPath
+	if p.absolute {
+		subject = rootPrefix + relPath
+	}
+	if !caseSensitive {
+		subject = strings.ToLower(subject)
+	}
+	matched, _ := doublestar.Match(p.glob, subject)
+	return matched
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestPathMatcher(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "target")
+
+	tests := []struct {
+		name          string
+		patterns      []string
+		caseSensitive bool
+		path          string
+		want          bool
+	}{
+		{"no patterns", nil, true, "a.txt", false},
+		{"bare name at the top", []string{"skip"}, true, "skip", true},
+		{"bare name at any depth", []string{"skip"}, true, "a/b/skip", true},
+		{"directory matches its contents", []string{"skip"}, true, "a/skip/c/d.txt", true},
+		{"name wildcard", []string{"*abc*"}, true, "x/1abc2.txt", true},
+		{"relative path", []string{"a/b"}, true, "a/b/c.txt", true},
+		{"relative path only from the root", []string{"a/b"}, true, "x/a/b/c.txt", false},
+		{"double star", []string{"**/*.part"}, true, "a/b/c.part", true},
+		{"trailing slash", []string{"tmp/"}, true, "tmp/x", true},
+		{"negation includes again", []string{"a/b", "!a/b/*.pdf"}, true, "a/b/c.pdf", false},
+		{"negation leaves others", []string{"a/b", "!a/b/*.pdf"}, true, "a/b/c.txt", true},
+		{"last match wins", []string{"!*.pdf", "*.pdf"}, true, "c.pdf", true},
+		{"regular expression", []string{`re:^logs/\d+\.log$`}, true, "logs/12.log", true},
+		{"regular expression no match", []string{`re:^logs/\d+\.log$`}, true, "logs/x.log", false},
+		{"case sensitive", []string{"*.PDF"}, true, "a.pdf", false},
+		{"case insensitive", []string{"*.PDF"}, false, "a.pdf", true},
+		{"case insensitive regular expression", []string{"re:^A/"}, false, "a/b.txt", true},
+		{"absolute pattern", []string{filepath.ToSlash(root) + "/a/*.txt"}, true, "a/b.txt", true},
+		{"blank entries are skipped", []string{" ", ""}, true, "a.txt", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := compilePathPatterns(tt.patterns, tt.caseSensitive)
+			if err != nil {
+				t.Fatalf("compilePathPatterns(%q): %v", tt.patterns, err)
+			}
+			path := filepath.Join(root, filepath.FromSlash(tt.path))
+			if got := m.matches(path, root); got != tt.want {
+				t.Errorf("matches(%s) with %q = %v, want %v", tt.path, tt.patterns, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompilePathPatternsErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+	}{
+		{"invalid regular expression", []string{"re:(unclosed"}},
+		{"invalid glob", []string{"a/[b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := compilePathPatterns(tt.patterns, true); err == nil {
+				t.Errorf("compilePathPatterns(%q) succeeded, want an error", tt.patterns)
+			}
+		})
+	}
+}
+
+func TestWatchIncludeAndExcludePaths(t *testing.T) {
+	root := t.TempDir()
+	caseSensitive := true
+	entry := Watch{ID: "docs", TargetPath: root}
+	entry.FileTypes = []string{".csv", ".txt"}
+	entry.IncludePaths = []string{"incoming/**"}
+	entry.ExcludePaths = []string{"*.partial.csv", "incoming/archive"}
+	entry.CaseSensitive = &caseSensitive
+	config := &Config{Watches: []Watch{entry}}
+	if err := normalizeWatches(config); err != nil {
+		t.Fatal(err)
+	}
+	watch := &config.Watches[0]
+
+	in := func(rel string) string { return filepath.Join(root, filepath.FromSlash(rel)) }
+	if !isIncludedFile(in("incoming/2024/a.csv"), watch) || isExcludedPath(in("incoming/2024/a.csv"), watch) {
+		t.Error("file below include_path was not taken")
+	}
+	if isIncludedFile(in("outgoing/a.csv"), watch) {
+		t.Error("file outside include_path was taken")
+	}
+	if isIncludedFile(in("incoming/a.pdf"), watch) {
+		t.Error("file_type was not applied together with include_path")
+	}
+	if !isExcludedPath(in("incoming/a.partial.csv"), watch) || !isExcludedPath(in("incoming/archive/old.csv"), watch) {
+		t.Error("exclude_path did not exclude")
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// placeholderValues holds what the placeholders of a command expand to for one run.
+type placeholderValues struct {
+	filePath      string
+	task          *Task  // nil for init_run and exit_run
+	watch         *Watch // nil for init_run and exit_run
+	hashAlgorithm string
+	hashMaxSize   int64
+	fileInfo      os.FileInfo
+	statDone      bool
+	fileList      string // Temporary file written for {filelist}, removed by cleanup
+}
+
+// knownPlaceholders lists every placeholder name that can be used in a command argument.
+var knownPlaceholders = map[string]bool{
+	"filepath":       true,
+	"filename":       true,
+	"basename":       true,
+	"ext":            true,
+	"dir":            true,
+	"relpath":        true,
+	"event":          true,
+	"oldpath":        true,
+	"size":           true,
+	"mtime":          true,
+	"timestamp":      true,
+	"worker_id":      true,
+	"processed_path": true,
+	"hash":           true,
+	"filepaths":      true,
+	"filelist":       true,
+}
+
+// validatePlaceholders checks that every placeholder in the arguments of a command is known.
+// {filepaths} must be a whole argument, since it expands to one argument per file.
+func validatePlaceholders(command []string) error {
+	for i, arg := range command {
+		if i == 0 {
+			continue // Placeholders are only expanded in arguments
+		}
+		_, err := scanPlaceholders(arg, func(name, param string) (string, error) {
+			if !knownPlaceholders[name] {
+				return "", fmt.Errorf("unknown placeholder {%s} in argument %q", name, arg)
+			}
+			if name == "filepaths" && arg != "{filepaths}" {
+				return "", fmt.Errorf("placeholder {filepaths} must be a whole argument, not part of %q (use {filelist} to pass the files in one argument)", arg)
+			}
+			if param != "" && name != "timestamp" {
+				return "", fmt.Errorf("placeholder {%s} does not take a format in argument %q", name, arg)
+			}
+			return "", nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expandPlaceholders replaces every placeholder in arg with its value.
+func expandPlaceholders(arg string, values *placeholderValues) (string, error) {
+	return scanPlaceholders(arg, values.lookup)
+}
+
+// scanPlaceholders walks through arg, passing each {name} or {name:param} placeholder to
+// replace and building the result. "{{" and "}}" stand for literal braces.
+func scanPlaceholders(arg string, replace func(name, param string) (string, error)) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(arg); i++ {
+		c := arg[i]
+		switch {
+		case c == '{' && i+1 < len(arg) && arg[i+1] == '{':
+			b.WriteByte('{')
+			i++
+		case c == '}' && i+1 < len(arg) && arg[i+1] == '}':
+			b.WriteByte('}')
+			i++
+		case c == '{':
+			end := strings.IndexByte(arg[i+1:], '}')
+			if end < 0 {
+				return "", fmt.Errorf("unclosed placeholder in argument %q (use {{ for a literal brace)", arg)
+			}
+			name, param, _ := strings.Cut(arg[i+1:i+1+end], ":")
+			value, err := replace(name, param)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(value)
+			i += end + 1
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), nil
+}
+
+// lookup returns the value of a single placeholder.
+func (v *placeholderValues) lookup(name, param string) (string, error) {
+	switch name {
+	case "filepath":
+		return v.filePath, nil
+	case "filepaths":
+		return strings.Join(v.filePaths(), " "), nil
+	case "filelist":
+		return v.writeFileList()
+	case "filename":
+		return v.pathPart(filepath.Base), nil
+	case "basename":
+		return v.pathPart(func(p string) string {
+			base := filepath.Base(p)
+			return strings.TrimSuffix(base, filepath.Ext(base))
+		}), nil
+	case "ext":
+		return v.pathPart(filepath.Ext), nil
+	case "dir":
+		return v.pathPart(filepath.Dir), nil
+	case "relpath":
+		if v.watch == nil || v.filePath == "" {
+			return "", nil
+		}
+		return filepath.FromSlash(relativeToRoot(v.filePath, v.watch)), nil
+	case "event":
+		if v.task == nil {
+			return "", nil
+		}
+		return string(v.task.Event), nil
+	case "oldpath":
+		if v.task == nil {
+			return "", nil
+		}
+		return v.task.OldPath, nil
+	case "size":
+		if fi := v.stat(); fi != nil {
+			return strconv.FormatInt(fi.Size(), 10), nil
+		}
+		return "", nil
+	case "mtime":
+		if fi := v.stat(); fi != nil {
+			return fi.ModTime().Format(time.RFC3339), nil
+		}
+		return "", nil
+	case "timestamp":
+		layout := param
+		if layout == "" {
+			layout = time.RFC3339
+		}
+		ts := time.Now()
+		if v.task != nil {
+			ts = v.task.Timestamp
+		}
+		return ts.Format(layout), nil
+	case "worker_id":
+		if v.task == nil || v.task.WorkerID == 0 {
+			return "", nil
+		}
+		return strconv.Itoa(v.task.WorkerID), nil
+	case "hash":
+		if v.task != nil && v.task.Hash != "" {
+			return v.task.Hash, nil
+		}
+		if v.filePath == "" || v.hashAlgorithm == "" {
+			return "", nil
+		}
+		hash, err := hashFile(v.filePath, v.hashAlgorithm, v.hashMaxSize)
+		if err != nil {
+			return "", nil // Missing or too large to hash
+		}
+		return hash, nil
+	case "processed_path":
+		if v.watch == nil {
+			return "", nil
+		}
+		absPath, err := filepath.Abs(v.watch.ProcessedPath)
+		if err != nil {
+			return v.watch.ProcessedPath, nil
+		}
+		return absPath, nil
+	}
+	return "", fmt.Errorf("unknown placeholder {%s}", name)
+}
+
+// filePaths returns the paths of every file of a batch task, or just the file path.
+func (v *placeholderValues) filePaths() []string {
+	if v.task == nil {
+		if v.filePath == "" {
+			return nil
+		}
+		return []string{v.filePath}
+	}
+	var paths []string
+	for _, file := range v.task.files() {
+		paths = append(paths, file.Path)
+	}
+	return paths
+}
+
+// writeFileList writes the file paths to a temporary file, one per line, and returns its path.
+// The file is written once per command run.
+func (v *placeholderValues) writeFileList() (string, error) {
+	if v.fileList != "" {
+		return v.fileList, nil
+	}
+	f, err := os.CreateTemp("", "wtd-filelist-*.txt")
+	if err != nil {
+		return "", fmt.Errorf("error creating file list: %w", err)
+	}
+	defer f.Close()
+
+	v.fileList = f.Name()
+	for _, path := range v.filePaths() {
+		if _, err := fmt.Fprintln(f, path); err != nil {
+			return "", fmt.Errorf("error writing file list: %w", err)
+		}
+	}
+	return v.fileList, nil
+}
+
+// cleanup removes the temporary files created for the placeholders.
+func (v *placeholderValues) cleanup() {
+	if v.fileList != "" {
+		os.Remove(v.fileList)
+	}
+}
+
+// pathPart applies fn to the file path, or returns "" when there is no file.
+func (v *placeholderValues) pathPart(fn func(string) string) string {
+	if v.filePath == "" {
+		return ""
+	}
+	return fn(v.filePath)
+}
+
+// stat returns the file info of the file, looked up once per command run.
+func (v *placeholderValues) stat() os.FileInfo {
+	if !v.statDone && v.filePath != "" {
+		v.fileInfo, _ = os.Stat(v.filePath)
+		v.statDone = true
+	}
+	return v.fileInfo
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpandPlaceholders(t *testing.T) {
+	root := filepath.Join(string(filepath.Separator), "data", "in")
+	watch := &Watch{ID: "test", root: root}
+	filePath := filepath.Join(root, "2024", "report.final.csv")
+	task := &Task{
+		Path:      filePath,
+		OldPath:   filepath.Join(root, "report.tmp"),
+		Event:     RenameEvent,
+		Timestamp: time.Date(2024, 3, 5, 10, 30, 0, 0, time.UTC),
+		WorkerID:  3,
+	}
+	values := &placeholderValues{filePath: filePath, task: task, watch: watch}
+
+	tests := []struct {
+		arg  string
+		want string
+	}{
+		{"plain", "plain"},
+		{"{filepath}", filePath},
+		{"{filename}", "report.final.csv"},
+		{"{basename}", "report.final"},
+		{"{ext}", ".csv"},
+		{"{dir}", filepath.Join(root, "2024")},
+		{"{relpath}", filepath.Join("2024", "report.final.csv")},
+		{"{event}", "rename"},
+		{"{oldpath}", filepath.Join(root, "report.tmp")},
+		{"{worker_id}", "3"},
+		{"{timestamp:2006-01-02}", "2024-03-05"},
+		{"{timestamp}", "2024-03-05T10:30:00Z"},
+		{"--out={basename}.json", "--out=report.final.json"},
+		{"{{filepath}}", "{filepath}"},
+		{"{{{filename}}}", "{report.final.csv}"},
+		{"a}}b{{c", "a}b{c"},
+		{"{filepaths}", filePath},
+	}
+	for _, tt := range tests {
+		got, err := expandPlaceholders(tt.arg, values)
+		if err != nil {
+			t.Errorf("expandPlaceholders(%q): %v", tt.arg, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("expandPlaceholders(%q) = %q, want %q", tt.arg, got, tt.want)
+		}
+	}
+}
+
+func TestExpandFileInfoPlaceholders(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "data.bin")
+	if err := os.WriteFile(filePath, make([]byte, 1234), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(filePath, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	values := &placeholderValues{filePath: filePath}
+	got, err := expandPlaceholders("{size} bytes, changed {mtime}", values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "1234 bytes, changed " + mtime.Local().Format(time.RFC3339); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestExpandPlaceholdersWithoutTask(t *testing.T) {
+	values := &placeholderValues{}
+	for _, arg := range []string{"{event}", "{oldpath}", "{worker_id}", "{relpath}", "{filename}", "{processed_path}"} {
+		if got, err := expandPlaceholders(arg, values); err != nil || got != "" {
+			t.Errorf("expandPlaceholders(%q) = %q, %v, want an empty string", arg, got, err)
+		}
+	}
+}
+
+func TestValidatePlaceholders(t *testing.T) {
+	tests := []struct {
+		name    string
+		command []string
+		wantErr string
+	}{
+		{"known placeholders", []string{"cmd", "{filepath}", "--at={timestamp:15:04}"}, ""},
+		{"executable is not expanded", []string{"{unknown}", "x"}, ""},
+		{"escaped braces", []string{"cmd", "{{not a placeholder}}"}, ""},
+		{"batch placeholders", []string{"cmd", "--files", "{filepaths}", "--list={filelist}"}, ""},
+		{"filepaths inside an argument", []string{"cmd", "--files={filepaths}"}, "must be a whole argument"},
+		{"unknown placeholder", []string{"cmd", "{nope}"}, "unknown placeholder {nope}"},
+		{"format on other placeholder", []string{"cmd", "{filepath:x}"}, "does not take a format"},
+		{"unclosed placeholder", []string{"cmd", "{filepath"}, "unclosed placeholder"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validatePlaceholders(tt.command)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("validatePlaceholders(%q): %v", tt.command, err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("validatePlaceholders(%q) = %v, want an error containing %q", tt.command, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBatchPlaceholders(t *testing.T) {
+	dir := t.TempDir()
+	batch := &Task{Event: CreateEvent, Batch: []*Task{
+		{Path: filepath.Join(dir, "a.csv"), Event: CreateEvent},
+		{Path: filepath.Join(dir, "b.csv"), Event: CreateEvent},
+	}}
+	values := &placeholderValues{filePath: batch.Batch[0].Path, task: batch}
+	defer values.cleanup()
+
+	_, args, err := prepareCommandArgs([]string{"import", "{filepaths}", "--list", "{filelist}"}, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(args) != 4 || args[0] != batch.Batch[0].Path || args[1] != batch.Batch[1].Path {
+		t.Fatalf("args = %q, want one argument per file followed by the list", args)
+	}
+	data, err := os.ReadFile(args[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), batch.Batch[0].Path+"\n"+batch.Batch[1].Path+"\n"; got != want {
+		t.Errorf("file list = %q, want %q", got, want)
+	}
+
+	values.cleanup()
+	if _, err := os.Stat(args[3]); !os.IsNotExist(err) {
+		t.Errorf("file list was not removed: %v", err)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ignorePresets are named sets of exclude_path patterns for temporary and partial files
+// that applications create while they are still writing the real file.
+var ignorePresets = map[string][]string{
+	// Word/Excel lock and autosave files, LibreOffice lock files
+	"office": {"~$*", "~WRL*.tmp", ".~lock.*#"},
+	// Downloads in progress in Firefox, Chrome, Edge, Safari and Opera
+	"browsers": {"*.part", "*.crdownload", "*.partial", "*.download", "*.opdownload"},
+	// Swap, backup and autosave files of vim, emacs, kate and others
+	"editors": {"*.swp", "*.swo", "*.swx", "*~", ".#*", "#*#", "*.kate-swp", "*.bak"},
+	// Files and folders whose name starts with a dot
+	"hidden": {".*"},
+	// Temporary names used by rsync while a file is transferred (.name.XXXXXX)
+	"rsync": {`re:(^|/)\.[^/]+\.[A-Za-z0-9]{6}$`, ".~tmp~"},
+	// Generic temporary files
+	"temp": {"*.tmp", "*.temp"},
+}
+
+// presetPatterns returns the patterns of the given ignore_presets, or an error naming
+// the first unknown preset.
+func presetPatterns(presets []string) ([]string, error) {
+	var patterns []string
+	for _, name := range presets {
+		preset, ok := ignorePresets[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("unknown ignore preset %q (known presets: %s)", name, strings.Join(ignorePresetNames(), ", "))
+		}
+		patterns = append(patterns, preset...)
+	}
+	return patterns, nil
+}
+
+// ignorePresetNames returns the names of all ignore presets in alphabetical order.
+func ignorePresetNames() []string {
+	names := make([]string, 0, len(ignorePresets))
+	for name := range ignorePresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// presetWatch returns a normalized watch on root that uses the given presets and exclude_path.
+func presetWatch(t *testing.T, root string, presets, excludes []string) *Watch {
+	t.Helper()
+	entry := Watch{ID: "test", TargetPath: root}
+	entry.IgnorePresets = presets
+	entry.ExcludePaths = excludes
+	config := &Config{Watches: []Watch{entry}}
+	if err := normalizeWatches(config); err != nil {
+		t.Fatal(err)
+	}
+	return &config.Watches[0]
+}
+
+func TestIgnorePresets(t *testing.T) {
+	root := t.TempDir()
+	excluded := map[string][]string{
+		"office":   {"~$report.docx", "~WRL0001.tmp", ".~lock.sheet.ods#"},
+		"browsers": {"setup.exe.part", "movie.crdownload", "file.zip.download"},
+		"editors":  {"notes.txt.swp", "notes.txt~", ".#notes.txt", "#notes.txt#"},
+		"hidden":   {".env", "sub/.cache/data"},
+		"rsync":    {".data.csv.a1B2c3", "dir/.~tmp~/x"},
+		"temp":     {"build.tmp", "x.temp"},
+	}
+	kept := []string{"report.docx", "setup.exe", "notes.txt", "data.csv", "sub/file.temperature"}
+
+	for preset, names := range excluded {
+		watch := presetWatch(t, root, []string{preset}, nil)
+		for _, name := range names {
+			if !isExcludedPath(filepath.Join(root, filepath.FromSlash(name)), watch) {
+				t.Errorf("preset %s does not exclude %s", preset, name)
+			}
+		}
+		for _, name := range kept {
+			if isExcludedPath(filepath.Join(root, filepath.FromSlash(name)), watch) {
+				t.Errorf("preset %s excludes %s", preset, name)
+			}
+		}
+	}
+}
+
+func TestIgnorePresetsCombineWithExcludePaths(t *testing.T) {
+	root := t.TempDir()
+	watch := presetWatch(t, root, []string{" Temp ", "hidden"}, []string{"!keep.tmp", "*.log"})
+
+	tests := map[string]bool{
+		"a.tmp":    true,
+		"keep.tmp": false,
+		".env":     true,
+		"app.log":  true,
+		"data.csv": false,
+	}
+	for name, want := range tests {
+		if got := isExcludedPath(filepath.Join(root, name), watch); got != want {
+			t.Errorf("isExcludedPath(%s) = %v, want %v", name, got, want)
+		}
+	}
+
+	entry := Watch{ID: "test", TargetPath: root}
+	entry.IgnorePresets = []string{"nope"}
+	err := normalizeWatches(&Config{Watches: []Watch{entry}})
+	if err == nil || !strings.Contains(err.Error(), `unknown ignore preset "nope"`) {
+		t.Errorf("unknown preset error = %v", err)
+	}
+}
+
+func TestTempRenameAsCreate(t *testing.T) {
+	taskQueue = make(chan *Task, 10)
+	defer func() { taskQueue = nil }()
+
+	root := t.TempDir()
+	watch := presetWatch(t, root, []string{"browsers"}, nil)
+	watch.OnCreateRun = []string{"echo"}
+	watch.OnRenameRun = []string{"echo"}
+	watch.TempRenameAsCreate = true
+	config := &Config{DebounceMode: DebounceModeLeading}
+
+	path := filepath.Join(root, "video.mp4")
+	if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	handleRenameEvent(path, path+".part", watch, config, nil)
+
+	if len(taskQueue) != 1 {
+		t.Fatalf("%d tasks queued, want 1", len(taskQueue))
+	}
+	if task := <-taskQueue; task.Event != CreateEvent || task.Path != path {
+		t.Errorf("got %s, want a create event for %s", task, path)
+	}
+}
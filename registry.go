@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	failedTasks       atomic.Int64                // Tasks whose processing failed, for the exit code of --once
+	inFlight          atomic.Int64                // Files not done yet, see isIdle
+	queuedTasks       = make(map[string]*Task)    // Tasks waiting for a worker, by task ID
+	canceledTasks     = make(map[string]bool)     // Queued tasks canceled before a worker picked them up
+	activeTasks       = make(map[int]*activeTask) // Tasks being processed, by worker ID
+	taskRegistryMutex sync.Mutex
+)
+
+// activeTask is a task a worker is currently processing.
+type activeTask struct {
+	task     *Task
+	workerID int
+	started  time.Time
+	cancel   context.CancelFunc
+}
+
+// trackQueued records a task that was put on a queue. A canceled task that is queued again
+// for a retry stays canceled.
+func trackQueued(task *Task) {
+	taskRegistryMutex.Lock()
+	defer taskRegistryMutex.Unlock()
+	if _, queued := queuedTasks[task.ID]; queued || canceledTasks[task.ID] {
+		return
+	}
+	queuedTasks[task.ID] = task
+	inFlight.Add(1)
+}
+
+// startWork records that a worker picked up a task and returns the context its commands run
+// with. It returns false if the task was canceled while it was queued.
+func startWork(workerID int, task *Task) (context.Context, bool) {
+	taskRegistryMutex.Lock()
+	defer taskRegistryMutex.Unlock()
+
+	if canceledTasks[task.ID] {
+		delete(canceledTasks, task.ID)
+		inFlight.Add(-1)
+		return nil, false
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	activeTasks[workerID] = &activeTask{task: task, workerID: workerID, started: time.Now(), cancel: cancel}
+	inFlight.Add(1)
+	if _, queued := queuedTasks[task.ID]; queued {
+		delete(queuedTasks, task.ID)
+		inFlight.Add(-1)
+	}
+	return ctx, true
+}
+
+// finishWork records that a worker is done with its task.
+func finishWork(workerID int) {
+	taskRegistryMutex.Lock()
+	defer taskRegistryMutex.Unlock()
+	if active, ok := activeTasks[workerID]; ok {
+		active.cancel()
+		delete(activeTasks, workerID)
+		inFlight.Add(-1)
+	}
+}
+
+// cancelTask cancels a queued or running task. A queued task is dropped when a worker picks
+// it up, the commands of a running task are stopped. It returns the state the task was in.
+func cancelTask(id string) (string, error) {
+	taskRegistryMutex.Lock()
+	defer taskRegistryMutex.Unlock()
+
+	if _, ok := queuedTasks[id]; ok {
+		delete(queuedTasks, id)
+		canceledTasks[id] = true
+		return "queued", nil
+	}
+	for _, active := range activeTasks {
+		if active.task.ID == id {
+			active.cancel()
+			return "running", nil
+		}
+	}
+	return "", fmt.Errorf("no queued or running task with id %s", id)
+}
+
+// queuedTaskList returns the tasks waiting for a worker, oldest first.
+func queuedTaskList() []*Task {
+	taskRegistryMutex.Lock()
+	defer taskRegistryMutex.Unlock()
+
+	tasks := make([]*Task, 0, len(queuedTasks))
+	for _, task := range queuedTasks {
+		tasks = append(tasks, task)
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].Timestamp.Before(tasks[j].Timestamp) })
+	return tasks
+}
+
+// activeTaskList returns the tasks being processed, by worker ID.
+func activeTaskList() []activeTask {
+	taskRegistryMutex.Lock()
+	defer taskRegistryMutex.Unlock()
+
+	active := make([]activeTask, 0, len(activeTasks))
+	for _, a := range activeTasks {
+		active = append(active, *a)
+	}
+	sort.Slice(active, func(i, j int) bool { return active[i].workerID < active[j].workerID })
+	return active
+}
+
+// busyWorkerCount returns the number of workers currently processing a task.
+func busyWorkerCount() int {
+	taskRegistryMutex.Lock()
+	defer taskRegistryMutex.Unlock()
+	return len(activeTasks)
+}
+
+// isIdle reports whether no file is waiting to be queued, queued or being processed.
+//
+// inFlight counts the debounced events, settling files, pending batches, files waiting
+// for min_age and queued or running tasks. Each of these stages hands a file on to the
+// next one before it stops counting it, and a queued task is counted until its worker is
+// done with it, so the count can't drop to 0 while a file moves between stages.
+func isIdle() bool {
+	return inFlight.Load() == 0
+}
+
+// isTaskQueued reports whether a task for a file is waiting for a worker.
+func isTaskQueued(filePath string) bool {
+	taskRegistryMutex.Lock()
+	defer taskRegistryMutex.Unlock()
+
+	for _, task := range queuedTasks {
+		for _, file := range task.files() {
+			if file.Path == filePath {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIsIdleFollowsFileThroughStages(t *testing.T) {
+	taskQueue = make(chan *Task, 10)
+	defer func() { taskQueue = nil }()
+	saved := inFlight.Swap(0)
+	defer inFlight.Store(saved)
+
+	root := t.TempDir()
+	path := filepath.Join(root, "a.txt")
+	if err := os.WriteFile(path, []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	watch := &Watch{ID: "test", TargetPath: root, root: root}
+	watch.Settle = 100
+
+	dispatchTask(newTask(watch, path, CreateEvent), watch, &Config{})
+	if isIdle() {
+		t.Error("idle while a file is settling")
+	}
+
+	var task *Task
+	select {
+	case task = <-taskQueue:
+	case <-time.After(2 * time.Second):
+		t.Fatal("settled file was not queued")
+	}
+	if isIdle() {
+		t.Error("idle while a task is queued")
+	}
+
+	if _, ok := startWork(904, task); !ok {
+		t.Fatal("worker could not pick up the task")
+	}
+	if isIdle() {
+		t.Error("idle while a task is running")
+	}
+	finishWork(904)
+	if !isIdle() {
+		t.Errorf("not idle after the task is done, %d in flight", inFlight.Load())
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// RetryPolicy controls how often and how fast a failed command is retried.
+type RetryPolicy struct {
+	Retries    int     `yaml:"retries"`    // Retries after the first failure (0 = no retry)
+	Initial    int     `yaml:"initial"`    // Milliseconds before the first retry (default 1000)
+	Multiplier float64 `yaml:"multiplier"` // Growth factor of the delay between retries (default 2)
+	Max        int     `yaml:"max"`        // Upper bound of the delay in milliseconds (default 60000)
+	Jitter     float64 `yaml:"jitter"`     // Random variation of each delay, as a fraction between 0 and 1
+}
+
+// attemptRecord describes a single run of a command, for the failure report.
+type attemptRecord struct {
+	Attempt    int       `json:"attempt"`
+	StartedAt  time.Time `json:"started_at"`
+	DurationMs int64     `json:"duration_ms"`
+	ExitCode   int       `json:"exit_code"`
+	Reason     string    `json:"reason,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// failureReport is written next to a file moved to failed_path.
+type failureReport struct {
+	Path       string          `json:"path"`
+	Event      EventType       `json:"event"`
+	Watch      string          `json:"watch"`
+	TaskID     string          `json:"task_id"`
+	Command    []string        `json:"command"`
+	Reason     string          `json:"reason"`
+	ExitCode   int             `json:"exit_code"`
+	StderrTail []string        `json:"stderr_tail"`
+	Attempts   []attemptRecord `json:"attempts"`
+	FailedAt   time.Time       `json:"failed_at"`
+}
+
+// validateRetryPolicy checks a retry policy for values that make no sense.
+func validateRetryPolicy(policy *RetryPolicy) error {
+	if policy.Retries < 0 || policy.Initial < 0 || policy.Max < 0 {
+		return errors.New("retries, initial and max must not be negative")
+	}
+	if policy.Multiplier != 0 && policy.Multiplier < 1 {
+		return fmt.Errorf("multiplier must be at least 1, got %v", policy.Multiplier)
+	}
+	if policy.Jitter < 0 || policy.Jitter > 1 {
+		return fmt.Errorf("jitter must be between 0 and 1, got %v", policy.Jitter)
+	}
+	return nil
+}
+
+// delay returns how long to wait before the given retry (1 = first retry).
+func (p *RetryPolicy) delay(retry int) time.Duration {
+	initial, multiplier, max := p.Initial, p.Multiplier, p.Max
+	if initial == 0 {
+		initial = 1000
+	}
+	if multiplier == 0 {
+		multiplier = 2
+	}
+	if max == 0 {
+		max = 60000
+	}
+
+	ms := math.Min(float64(initial)*math.Pow(multiplier, float64(retry-1)), float64(max))
+	if p.Jitter > 0 {
+		ms += ms * p.Jitter * (2*rand.Float64() - 1)
+	}
+	// Jitter must not push the delay past max
+	ms = math.Min(ms, float64(max))
+	return time.Duration(ms) * time.Millisecond
+}
+
+// retryPolicy returns the retry policy of an action, falling back to the watch default.
+func (a *Action) retryPolicy(watch *Watch) *RetryPolicy {
+	if a.Retry != nil {
+		return a.Retry
+	}
+	return &watch.Retry
+}
+
+// commandOptions returns the run settings of an action for a task, falling back to the global defaults.
+func (a *Action) commandOptions(task *Task, watch *Watch, config *Config) commandOptions {
+	timeout := a.Timeout
+	if timeout == 0 {
+		timeout = config.CommandTimeout
+	}
+	return commandOptions{
+		Timeout:   time.Duration(timeout) * time.Millisecond,
+		KillGrace: time.Duration(config.KillGrace) * time.Millisecond,
+		Task:      task,
+		Watch:     watch,
+		Env:       append(expandEnv(config.Env), expandEnv(a.Env)...),
+		DryRun:    config.DryRun,
+
+		HashAlgorithm: config.HashAlgorithm,
+		HashMaxSize:   config.HashMaxSize,
+	}
+}
+
+// retryLater is returned by runAction when a failed command is to be retried after wait,
+// with the task handed back to the worker pool in the meantime.
+type retryLater struct {
+	wait time.Duration
+	err  error
+}
+
+func (r *retryLater) Error() string {
+	return fmt.Sprintf("retrying in %v: %v", r.wait, r.err)
+}
+
+func (r *retryLater) Unwrap() error {
+	return r.err
+}
+
+// errRetryScheduled is returned by processFile for a task that will be queued again once
+// the retry delay of its failed command has passed.
+var errRetryScheduled = errors.New("retry scheduled")
+
+// runAction executes the command of an action for a task, retrying with backoff on failure.
+// It returns the history of all attempts made, including those of earlier runs of the task.
+// A task that does not have to keep its place in a partition doesn't wait for a retry on
+// the worker: runAction returns a *retryLater instead.
+func runAction(ctx context.Context, action *Action, task *Task, watch *Watch, config *Config) ([]attemptRecord, error) {
+	policy := action.retryPolicy(watch)
+	opts := action.commandOptions(task, watch, config)
+
+	history := task.retryHistory
+	for attempt := len(history) + 1; ; attempt++ {
+		task.Attempt = attempt
+		started := time.Now()
+		err := executeCommandWithOptions(ctx, action.Run, task.Path, opts)
+		duration := time.Since(started)
+
+		record := attemptRecord{
+			Attempt:    attempt,
+			StartedAt:  started,
+			DurationMs: duration.Milliseconds(),
+		}
+		if err == nil {
+			observeCommand(watch, duration, 0, "")
+			history = append(history, record)
+			return history, nil
+		}
+
+		record.Error = err.Error()
+		record.ExitCode = -1
+		record.Reason = FailureReasonExit
+		var cmdErr *CommandError
+		if errors.As(err, &cmdErr) {
+			record.ExitCode = cmdErr.ExitCode
+			record.Reason = cmdErr.Reason
+		}
+		observeCommand(watch, duration, record.ExitCode, record.Reason)
+		history = append(history, record)
+
+		if attempt > policy.Retries || ctx.Err() != nil {
+			return history, err
+		}
+
+		wait := policy.delay(attempt)
+		logError("Command for %s failed (attempt %d of %d), retrying in %v: %v", task, attempt, policy.Retries+1, wait, err)
+		if task.Partition == "" {
+			task.retryHistory = history
+			return history, &retryLater{wait: wait, err: err}
+		}
+		// Later tasks of the partition must not overtake this one, so it waits on the worker
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return history, err
+		}
+	}
+}
+
+// scheduleRetry queues a task again once wait has passed. It is listed as queued in the
+// meantime, so that it can be canceled and --once waits for it.
+func scheduleRetry(task *Task, wait time.Duration) {
+	trackQueued(task)
+	time.AfterFunc(wait, func() {
+		enqueueTask(task)
+	})
+}
+
+// handleFailedFile moves a file whose command failed for good to the failed_path of its
+// watch, together with a .error.json report. It does nothing if failed_path is not set.
+func handleFailedFile(task *Task, watch *Watch, action *Action, history []attemptRecord, cmdErr error) {
+	if watch.FailedPath == "" || task.Event == RemoveEvent {
+		return
+	}
+	if _, err := os.Stat(task.Path); err != nil {
+		logError("Not moving %s to failed path: %v", task.Path, err)
+		return
+	}
+
+	report := failureReport{
+		Path:     task.Path,
+		Event:    task.Event,
+		Watch:    watch.ID,
+		TaskID:   task.ID,
+		Command:  action.Run,
+		Reason:   FailureReasonExit,
+		ExitCode: -1,
+		Attempts: history,
+		FailedAt: time.Now(),
+	}
+	var commandErr *CommandError
+	if errors.As(cmdErr, &commandErr) {
+		report.Reason = commandErr.Reason
+		report.ExitCode = commandErr.ExitCode
+		report.StderrTail = commandErr.StderrTail
+	}
+
+	destPath, err := moveFileToFailedDir(task.Path, watch)
+	observePostProcess(watch, "failed", err)
+	if err != nil {
+		logError("Error moving failed file %s: %v", task.Path, err)
+		return
+	}
+	if err := writeFailureReport(destPath+".error.json", &report); err != nil {
+		logError("Error writing failure report for %s: %v", destPath, err)
+	}
+}
+
+// moveFileToFailedDir moves a file that could not be processed to the failed directory
+// and returns its new path.
+func moveFileToFailedDir(filePath string, watch *Watch) (string, error) {
+	absDestPath, err := filepath.Abs(filepath.Join(watch.FailedPath, filepath.Base(filePath)))
+	if err != nil {
+		return "", fmt.Errorf("error getting absolute path for failed file %s: %w", filePath, err)
+	}
+
+	if err := os.MkdirAll(watch.FailedPath, 0755); err != nil {
+		return "", fmt.Errorf("error creating failed directory %s: %w", watch.FailedPath, err)
+	}
+
+	if err := os.Rename(filePath, absDestPath); err != nil {
+		return "", fmt.Errorf("error moving file: %w", err)
+	}
+
+	logError("Moved failed file to: %s", absDestPath)
+	return absDestPath, nil
+}
+
+// writeFailureReport writes the failure report as indented JSON.
+func writeFailureReport(reportPath string, report *failureReport) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling failure report: %w", err)
+	}
+	if err := os.WriteFile(reportPath, data, 0644); err != nil {
+		return fmt.Errorf("error writing failure report: %w", err)
+	}
+	return nil
+}
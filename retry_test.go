@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		policy RetryPolicy
+		retry  int
+		want   time.Duration
+	}{
+		{RetryPolicy{}, 1, time.Second},
+		{RetryPolicy{}, 3, 4 * time.Second},
+		{RetryPolicy{}, 10, time.Minute},
+		{RetryPolicy{Initial: 100, Multiplier: 3}, 3, 900 * time.Millisecond},
+		{RetryPolicy{Initial: 100, Multiplier: 3, Max: 500}, 3, 500 * time.Millisecond},
+		{RetryPolicy{Initial: 250, Multiplier: 1}, 5, 250 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.delay(tt.retry); got != tt.want {
+			t.Errorf("%+v.delay(%d) = %v, want %v", tt.policy, tt.retry, got, tt.want)
+		}
+	}
+}
+
+func TestRetryDelayJitter(t *testing.T) {
+	policy := RetryPolicy{Initial: 1000, Jitter: 0.5}
+	varied := false
+	for i := 0; i < 100; i++ {
+		got := policy.delay(1)
+		if got < 500*time.Millisecond || got > 1500*time.Millisecond {
+			t.Fatalf("delay with jitter 0.5 = %v, want between 500ms and 1.5s", got)
+		}
+		if got != time.Second {
+			varied = true
+		}
+	}
+	if !varied {
+		t.Error("jitter never changed the delay")
+	}
+}
+
+func TestRetryDelayJitterStaysBelowMax(t *testing.T) {
+	policy := RetryPolicy{Initial: 1000, Max: 1000, Jitter: 1}
+	for i := 0; i < 100; i++ {
+		if got := policy.delay(3); got > time.Second {
+			t.Fatalf("delay with jitter = %v, want at most max", got)
+		}
+	}
+}
+
+func TestValidateRetryPolicy(t *testing.T) {
+	valid := []RetryPolicy{{}, {Retries: 3, Initial: 10, Multiplier: 1.5, Max: 100, Jitter: 1}}
+	for _, policy := range valid {
+		if err := validateRetryPolicy(&policy); err != nil {
+			t.Errorf("validateRetryPolicy(%+v) = %v", policy, err)
+		}
+	}
+	invalid := []RetryPolicy{{Retries: -1}, {Multiplier: 0.5}, {Jitter: 1.5}, {Max: -1}}
+	for _, policy := range invalid {
+		if err := validateRetryPolicy(&policy); err == nil {
+			t.Errorf("validateRetryPolicy(%+v) accepted an invalid policy", policy)
+		}
+	}
+}
+
+// failingTwice is a command that fails on its first two runs in a directory and succeeds after.
+var failingTwice = []string{"sh", "-c", `n=$(cat runs 2>/dev/null || echo 0); n=$((n+1)); echo $n > runs; [ $n -ge 3 ] || exit 7`}
+
+func TestRunActionRetries(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh")
+	}
+	dir := t.TempDir()
+	// A partitioned task keeps its place in the partition, so it retries on the worker
+	task := &Task{Path: filepath.Join(dir, "file.txt"), Event: CreateEvent, Partition: "p"}
+	watch := &Watch{ID: "test"}
+
+	action := &Action{Run: failingTwice, Retry: &RetryPolicy{Retries: 2, Initial: 1}}
+	history, err := runAction(context.Background(), action, task, watch, &Config{})
+	if err != nil {
+		t.Fatalf("command failed after retries: %v", err)
+	}
+	if len(history) != 3 || history[0].ExitCode != 7 || history[2].Error != "" {
+		t.Errorf("history = %+v, want two failures with exit code 7 and a success", history)
+	}
+
+	os.Remove(filepath.Join(dir, "runs"))
+	watch.Retry = RetryPolicy{Retries: 1, Initial: 1}
+	action.Retry = nil
+	history, err = runAction(context.Background(), action, task, watch, &Config{})
+	if err == nil {
+		t.Fatal("command succeeded although it ran out of retries")
+	}
+	if len(history) != 2 {
+		t.Errorf("made %d attempts with the watch policy, want 2", len(history))
+	}
+}
+
+func TestRunActionHandsBackRetries(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh")
+	}
+	dir := t.TempDir()
+	task := &Task{Path: filepath.Join(dir, "file.txt"), Event: CreateEvent}
+	watch := &Watch{ID: "test"}
+	action := &Action{Run: failingTwice, Retry: &RetryPolicy{Retries: 2, Initial: 1}}
+
+	// Each failure returns to the worker, and the next run continues the attempt count
+	for attempt := 1; attempt <= 2; attempt++ {
+		history, err := runAction(context.Background(), action, task, watch, &Config{})
+		var retry *retryLater
+		if !errors.As(err, &retry) {
+			t.Fatalf("attempt %d: error %v, want a retry for later", attempt, err)
+		}
+		if len(history) != attempt || task.Attempt != attempt {
+			t.Errorf("attempt %d: %d attempts in the history, task at attempt %d", attempt, len(history), task.Attempt)
+		}
+	}
+	history, err := runAction(context.Background(), action, task, watch, &Config{})
+	if err != nil || len(history) != 3 {
+		t.Errorf("third run: %d attempts, error %v", len(history), err)
+	}
+}
+
+func TestHandleFailedFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "broken.csv")
+	if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	watch := &Watch{ID: "test"}
+	watch.FailedPath = filepath.Join(dir, "failed")
+	task := &Task{ID: "t1", Path: path, Event: CreateEvent, WatchID: "test"}
+	history := []attemptRecord{{Attempt: 1, ExitCode: 3}}
+
+	handleFailedFile(task, watch, &Action{Run: []string{"import"}}, history, &CommandError{ExitCode: 3, StderrTail: []string{"bad row"}})
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("failed file is still in place: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(watch.FailedPath, "broken.csv.error.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report failureReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.ExitCode != 3 || report.TaskID != "t1" || len(report.StderrTail) != 1 || len(report.Attempts) != 1 {
+		t.Errorf("report = %+v", report)
+	}
+}
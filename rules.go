@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Constants for rule_match values.
+const (
+	RuleMatchFirst = "first" // Only the first matching rule runs
+	RuleMatchAll   = "all"   // Every matching rule runs, in order
+)
+
+// Rule maps match conditions to an ordered list of actions. Empty conditions match everything.
+type Rule struct {
+	Name       string      `yaml:"name"`
+	Events     []EventType `yaml:"events"`      // create, write, rename, remove
+	Glob       string      `yaml:"glob"`        // Matched against the file name, or against the path relative to target_path if it contains a "/"
+	Extensions []string    `yaml:"extensions"`  // e.g. [".pdf", ".txt"]
+	PathPrefix string      `yaml:"path_prefix"` // Absolute, or relative to target_path
+	Actions    []Action    `yaml:"actions"`
+
+	FileFilter `yaml:",inline"` // Size, age and content type conditions
+}
+
+// Action is a command run by a rule.
+type Action struct {
+	Run     []string          `yaml:"run"`
+	Retry   *RetryPolicy      `yaml:"retry"`   // Overrides the retry policy of the watch
+	Timeout int               `yaml:"timeout"` // Milliseconds, overrides command_timeout (0 = use command_timeout)
+	Env     map[string]string `yaml:"env"`     // Added to the global env for this command
+	When    *FileFilter       `yaml:"when"`    // Only run the command for files that pass these conditions
+}
+
+// UnmarshalYAML allows an action to be written either as a mapping or as a plain command list.
+func (a *Action) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.SequenceNode {
+		return value.Decode(&a.Run)
+	}
+	type plain Action
+	return value.Decode((*plain)(a))
+}
+
+// validateRules checks the rules of a watch for mistakes that would only show up at runtime.
+func validateRules(watch *Watch) error {
+	switch watch.RuleMatch {
+	case "":
+		watch.RuleMatch = RuleMatchFirst
+	case RuleMatchFirst, RuleMatchAll:
+	default:
+		return fmt.Errorf("watch %s: invalid rule_match value: %s", watch.ID, watch.RuleMatch)
+	}
+
+	for i, rule := range watch.Rules {
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		for _, eventType := range rule.Events {
+			if !isValidEventType(eventType) {
+				return fmt.Errorf("watch %s: rule %s: unknown event type: %s", watch.ID, name, eventType)
+			}
+		}
+		if rule.Glob != "" {
+			if _, err := filepath.Match(rule.Glob, ""); err != nil {
+				return fmt.Errorf("watch %s: rule %s: invalid glob %q: %w", watch.ID, name, rule.Glob, err)
+			}
+		}
+		if err := rule.FileFilter.validate(); err != nil {
+			return fmt.Errorf("watch %s: rule %s: %w", watch.ID, name, err)
+		}
+		if len(rule.Actions) == 0 {
+			return fmt.Errorf("watch %s: rule %s: no actions defined", watch.ID, name)
+		}
+		for j, action := range rule.Actions {
+			if len(action.Run) == 0 {
+				return fmt.Errorf("watch %s: rule %s: action %d has an empty run command", watch.ID, name, j+1)
+			}
+			if err := validatePlaceholders(action.Run); err != nil {
+				return fmt.Errorf("watch %s: rule %s: action %d: %w", watch.ID, name, j+1, err)
+			}
+			if action.Timeout < 0 {
+				return fmt.Errorf("watch %s: rule %s: action %d: timeout must not be negative", watch.ID, name, j+1)
+			}
+			if action.When != nil {
+				if err := action.When.validate(); err != nil {
+					return fmt.Errorf("watch %s: rule %s: action %d: when: %w", watch.ID, name, j+1, err)
+				}
+			}
+			if action.Retry != nil {
+				if err := validateRetryPolicy(action.Retry); err != nil {
+					return fmt.Errorf("watch %s: rule %s: action %d: retry: %w", watch.ID, name, j+1, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// isValidEventType reports whether eventType is one of the known event types.
+func isValidEventType(eventType EventType) bool {
+	switch eventType {
+	case CreateEvent, RenameEvent, WriteEvent, RemoveEvent:
+		return true
+	}
+	return false
+}
+
+// hasCommandsFor reports whether anything could run for the given event type on a watch,
+// so that events nobody is interested in are not queued at all.
+func hasCommandsFor(watch *Watch, eventType EventType) bool {
+	if len(legacyCommand(watch, eventType)) > 0 {
+		return true
+	}
+	for _, rule := range watch.Rules {
+		if len(rule.Events) == 0 || containsEventType(rule.Events, eventType) {
+			return true
+		}
+	}
+	return false
+}
+
+// selectActions returns the actions to run for a file event. Rules are evaluated in order;
+// when none of them match, the on*_run command of the event type is used.
+func selectActions(filePath string, watch *Watch, eventType EventType) []Action {
+	var actions []Action
+	for _, i := range matchingRules(filePath, watch, eventType) {
+		actions = append(actions, watch.Rules[i].Actions...)
+	}
+	if len(actions) > 0 {
+		return actions
+	}
+
+	if cmd := legacyCommand(watch, eventType); len(cmd) > 0 {
+		return []Action{{Run: cmd, Timeout: legacyTimeout(watch, eventType), Env: legacyEnv(watch, eventType)}}
+	}
+	return nil
+}
+
+// matchingRules returns the indexes of the rules whose actions run for a file event: the
+// first matching rule, or every matching one with rule_match: all.
+func matchingRules(filePath string, watch *Watch, eventType EventType) []int {
+	var matched []int
+	for i := range watch.Rules {
+		if !ruleMatches(&watch.Rules[i], filePath, watch, eventType) {
+			continue
+		}
+		matched = append(matched, i)
+		if watch.RuleMatch != RuleMatchAll {
+			break
+		}
+	}
+	return matched
+}
+
+// legacyTimeout returns the on*_timeout configured for the on*_run command of the event type.
+func legacyTimeout(watch *Watch, eventType EventType) int {
+	switch eventType {
+	case CreateEvent:
+		return watch.OnCreateTimeout
+	case RenameEvent:
+		return watch.OnRenameTimeout
+	case WriteEvent:
+		return watch.OnModifyTimeout
+	case RemoveEvent:
+		return watch.OnRemoveTimeout
+	}
+	return 0
+}
+
+// legacyEnv returns the on*_env configured for the on*_run command of the event type.
+func legacyEnv(watch *Watch, eventType EventType) map[string]string {
+	switch eventType {
+	case CreateEvent:
+		return watch.OnCreateEnv
+	case RenameEvent:
+		return watch.OnRenameEnv
+	case WriteEvent:
+		return watch.OnModifyEnv
+	case RemoveEvent:
+		return watch.OnRemoveEnv
+	}
+	return nil
+}
+
+// legacyCommand returns the on*_run command configured for the event type.
+func legacyCommand(watch *Watch, eventType EventType) []string {
+	switch eventType {
+	case CreateEvent:
+		return watch.OnCreateRun
+	case RenameEvent:
+		return watch.OnRenameRun
+	case WriteEvent:
+		return watch.OnModifyRun
+	case RemoveEvent:
+		return watch.OnRemoveRun
+	}
+	return nil
+}
+
+// ruleMatches checks every condition of a rule against a file event.
+func ruleMatches(rule *Rule, filePath string, watch *Watch, eventType EventType) bool {
+	if len(rule.Events) > 0 && !containsEventType(rule.Events, eventType) {
+		return false
+	}
+
+	if len(rule.Extensions) > 0 && !isAllowedFileType(filePath, rule.Extensions) {
+		return false
+	}
+
+	relPath := relativeToRoot(filePath, watch)
+
+	if rule.Glob != "" {
+		subject := filepath.Base(filePath)
+		if strings.Contains(rule.Glob, "/") {
+			subject = relPath
+		}
+		if matched, _ := filepath.Match(filepath.FromSlash(rule.Glob), filepath.FromSlash(subject)); !matched {
+			return false
+		}
+	}
+
+	if rule.PathPrefix != "" {
+		if filepath.IsAbs(rule.PathPrefix) {
+			if !isWithinRoot(filePath, filepath.Clean(rule.PathPrefix)) {
+				return false
+			}
+		} else if prefix := filepath.ToSlash(filepath.Clean(rule.PathPrefix)); prefix != "." && relPath != prefix && !strings.HasPrefix(relPath, prefix+"/") {
+			return false
+		}
+	}
+
+	// Size, age and content type conditions can't match a file that is gone
+	if rule.FileFilter.rejectReason(filePath) != "" {
+		return false
+	}
+
+	return true
+}
+
+// containsEventType reports whether eventType is in the list.
+func containsEventType(list []EventType, eventType EventType) bool {
+	for _, t := range list {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// relativeToRoot returns the slash-separated path of filePath relative to the watch root.
+func relativeToRoot(filePath string, watch *Watch) string {
+	relPath, err := filepath.Rel(watch.root, filePath)
+	if err != nil {
+		return filepath.ToSlash(filePath)
+	}
+	return filepath.ToSlash(relPath)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRuleMatches(t *testing.T) {
+	root := t.TempDir()
+	watch := &Watch{ID: "test", root: root}
+	files := map[string]string{
+		"invoices/a.pdf":      "%PDF-1.4 invoice",
+		"invoices/2024/b.PDF": "%PDF-1.4 invoice",
+		"invoices/empty.pdf":  "",
+		"notes.txt":           "hello",
+	}
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		rule  Rule
+		file  string
+		event EventType
+		want  bool
+	}{
+		{"no conditions", Rule{}, "notes.txt", CreateEvent, true},
+		{"event listed", Rule{Events: []EventType{CreateEvent, RenameEvent}}, "notes.txt", RenameEvent, true},
+		{"event not listed", Rule{Events: []EventType{CreateEvent}}, "notes.txt", WriteEvent, false},
+		{"extension", Rule{Extensions: []string{".pdf"}}, "invoices/a.pdf", CreateEvent, true},
+		{"extension ignores case", Rule{Extensions: []string{".pdf"}}, "invoices/2024/b.PDF", CreateEvent, true},
+		{"other extension", Rule{Extensions: []string{".pdf"}}, "notes.txt", CreateEvent, false},
+		{"glob on name", Rule{Glob: "*.pdf"}, "invoices/2024/b.PDF", CreateEvent, false},
+		{"glob on name at any depth", Rule{Glob: "a.*"}, "invoices/a.pdf", CreateEvent, true},
+		{"glob on relative path", Rule{Glob: "invoices/*.pdf"}, "invoices/a.pdf", CreateEvent, true},
+		{"glob on relative path not deeper", Rule{Glob: "invoices/*.pdf"}, "invoices/2024/b.PDF", CreateEvent, false},
+		{"path prefix", Rule{PathPrefix: "invoices"}, "invoices/2024/b.PDF", CreateEvent, true},
+		{"path prefix with slash", Rule{PathPrefix: "invoices/"}, "invoices/a.pdf", CreateEvent, true},
+		{"path prefix is a whole segment", Rule{PathPrefix: "invoices"}, "invoices-old/c.pdf", CreateEvent, false},
+		{"path prefix names the file", Rule{PathPrefix: "invoices/a.pdf"}, "invoices/a.pdf", CreateEvent, true},
+		{"absolute path prefix", Rule{PathPrefix: filepath.Join(root, "invoices")}, "invoices/a.pdf", CreateEvent, true},
+		{"absolute path prefix elsewhere", Rule{PathPrefix: filepath.Join(root, "invoices")}, "notes.txt", CreateEvent, false},
+		{"min size", Rule{FileFilter: FileFilter{MinSize: 1}}, "invoices/empty.pdf", CreateEvent, false},
+		{"max size", Rule{FileFilter: FileFilter{MaxSize: 4}}, "notes.txt", CreateEvent, false},
+		{"mime type", Rule{FileFilter: FileFilter{MimeTypes: []string{"application/pdf"}}}, "invoices/a.pdf", CreateEvent, true},
+		{"other mime type", Rule{FileFilter: FileFilter{MimeTypes: []string{"application/pdf"}}}, "notes.txt", CreateEvent, false},
+		{"file is gone", Rule{FileFilter: FileFilter{MinSize: 1}}, "missing.pdf", CreateEvent, false},
+		{"all conditions", Rule{Events: []EventType{CreateEvent}, Extensions: []string{".pdf"}, PathPrefix: "invoices", FileFilter: FileFilter{MinSize: 1}}, "invoices/a.pdf", CreateEvent, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(root, filepath.FromSlash(tt.file))
+			if got := ruleMatches(&tt.rule, path, watch, tt.event); got != tt.want {
+				t.Errorf("ruleMatches(%s, %s) = %v, want %v", tt.file, tt.event, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectActions(t *testing.T) {
+	root := t.TempDir()
+	path := filepath.Join(root, "report.pdf")
+	watch := &Watch{
+		ID:          "test",
+		root:        root,
+		OnCreateRun: []string{"legacy"},
+		Rules: []Rule{
+			{Extensions: []string{".pdf"}, Actions: []Action{{Run: []string{"first"}}}},
+			{Actions: []Action{{Run: []string{"second"}}, {Run: []string{"third"}}}},
+		},
+	}
+
+	runs := func(actions []Action) string {
+		var names []string
+		for _, action := range actions {
+			names = append(names, action.Run[0])
+		}
+		return strings.Join(names, ",")
+	}
+
+	watch.RuleMatch = RuleMatchFirst
+	if got := runs(selectActions(path, watch, CreateEvent)); got != "first" {
+		t.Errorf("rule_match first ran %q, want first", got)
+	}
+
+	watch.RuleMatch = RuleMatchAll
+	if got := runs(selectActions(path, watch, CreateEvent)); got != "first,second,third" {
+		t.Errorf("rule_match all ran %q, want first,second,third", got)
+	}
+
+	watch.Rules = []Rule{{Extensions: []string{".txt"}, Actions: []Action{{Run: []string{"text"}}}}}
+	watch.OnCreateTimeout = 1500
+	watch.OnCreateEnv = map[string]string{"MODE": "import"}
+	actions := selectActions(path, watch, CreateEvent)
+	if got := runs(actions); got != "legacy" {
+		t.Errorf("no matching rule ran %q, want the oncreate_run command", got)
+	}
+	if len(actions) == 1 && actions[0].Timeout != 1500 {
+		t.Errorf("oncreate_run timeout = %d, want the oncreate_timeout 1500", actions[0].Timeout)
+	}
+	if len(actions) == 1 && actions[0].Env["MODE"] != "import" {
+		t.Errorf("oncreate_run env = %v, want the oncreate_env", actions[0].Env)
+	}
+	if got := selectActions(path, watch, WriteEvent); got != nil {
+		t.Errorf("write event without rule or onmodify_run ran %v", got)
+	}
+}
+
+func TestValidateRules(t *testing.T) {
+	watch := &Watch{ID: "test", Rules: []Rule{{Actions: []Action{{Run: []string{"echo"}}}}}}
+	if err := validateRules(watch); err != nil {
+		t.Fatal(err)
+	}
+	if watch.RuleMatch != RuleMatchFirst {
+		t.Errorf("rule_match defaulted to %q, want %q", watch.RuleMatch, RuleMatchFirst)
+	}
+
+	tests := map[string]Watch{
+		"invalid rule_match":   {RuleMatch: "some"},
+		"unknown event type":   {Rules: []Rule{{Events: []EventType{"chmod"}, Actions: []Action{{Run: []string{"echo"}}}}}},
+		"invalid glob":         {Rules: []Rule{{Glob: "[", Actions: []Action{{Run: []string{"echo"}}}}}},
+		"no actions defined":   {Rules: []Rule{{Name: "empty"}}},
+		"empty run command":    {Rules: []Rule{{Actions: []Action{{}}}}},
+		"larger than max_size": {Rules: []Rule{{FileFilter: FileFilter{MinSize: 10, MaxSize: 5}, Actions: []Action{{Run: []string{"echo"}}}}}},
+	}
+	for want, watch := range tests {
+		watch.ID = "test"
+		if err := validateRules(&watch); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("validateRules error = %v, want %q", err, want)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	settlingFiles      = make(map[string]*Task) // Tasks held until their file settles, by path
+	settlingFilesMutex sync.Mutex
+)
+
+// dispatchTask hands a task to the worker pool. When settle detection is enabled for the
+// watch, the task is held until the file has stopped changing. Later events for a file
+// that is still settling are merged into the held task.
+func dispatchTask(task *Task, watch *Watch, config *Config) {
+	if watch.Settle <= 0 {
+		enqueueOrBatchTask(task, config)
+		return
+	}
+
+	settlingFilesMutex.Lock()
+	// A renamed file takes over the task held under its old name
+	if held, ok := settlingFiles[task.OldPath]; ok && task.OldPath != "" {
+		delete(settlingFiles, task.OldPath)
+		defer inFlight.Add(-1) // Once the task is held or queued under its new name
+		if merged, _ := coalesceEvents(held.Event, task.Event); merged == CreateEvent {
+			logInfo("Coalescing create of %s and its rename into a create of %s", task.OldPath, task.Path)
+			task.Event = CreateEvent
+			task.OldPath = ""
+		}
+	}
+
+	if held, ok := settlingFiles[task.Path]; ok {
+		merged, keep := coalesceEvents(held.Event, task.Event)
+		switch {
+		case !keep:
+			logInfo("Dropping %s: %s followed by %s cancel out", task.Path, held.Event, task.Event)
+			delete(settlingFiles, task.Path)
+			inFlight.Add(-1)
+		case merged == RemoveEvent:
+			// Nothing is left to settle, the removal is queued right away
+			delete(settlingFiles, task.Path)
+			task.Event = merged
+			settlingFilesMutex.Unlock()
+			enqueueOrBatchTask(task, config)
+			inFlight.Add(-1)
+			return
+		default:
+			logInfo("Still waiting for %s to settle, merging %s into %s", task.Path, task.Event, merged)
+			held.Event = merged
+			if task.OldPath != "" {
+				held.OldPath = task.OldPath
+			}
+		}
+		settlingFilesMutex.Unlock()
+		return
+	}
+
+	if task.Event == RemoveEvent {
+		settlingFilesMutex.Unlock()
+		enqueueOrBatchTask(task, config)
+		return
+	}
+	settlingFiles[task.Path] = task
+	inFlight.Add(1)
+	settlingFilesMutex.Unlock()
+
+	go func() {
+		stable := waitForStableFile(task.Path, watch)
+
+		// A later event may have taken over or cancelled the task in the meantime
+		settlingFilesMutex.Lock()
+		current := settlingFiles[task.Path] == task
+		if current {
+			delete(settlingFiles, task.Path)
+		}
+		settlingFilesMutex.Unlock()
+
+		if current && stable {
+			enqueueOrBatchTask(task, config)
+		}
+		if current {
+			inFlight.Add(-1)
+		}
+	}()
+}
+
+// waitForStableFile blocks until the size and modification time of a file have not changed
+// for the watch's settle time, and optionally until it can be opened exclusively.
+// It returns false if the file disappears or the settle timeout expires.
+func waitForStableFile(filePath string, watch *Watch) bool {
+	settle := time.Duration(watch.Settle) * time.Millisecond
+	interval := settle / 4
+	if interval < 50*time.Millisecond {
+		interval = 50 * time.Millisecond
+	} else if interval > time.Second {
+		interval = time.Second
+	}
+
+	var deadline time.Time
+	if watch.SettleTimeout > 0 {
+		deadline = time.Now().Add(time.Duration(watch.SettleTimeout) * time.Millisecond)
+	}
+
+	var lastSize int64 = -1
+	var lastModTime time.Time
+	stableSince := time.Now()
+
+	for {
+		fi, err := os.Stat(filePath)
+		if err != nil {
+			logInfo("File %s is gone while waiting for it to settle: %v", filePath, err)
+			return false
+		}
+
+		if fi.Size() != lastSize || !fi.ModTime().Equal(lastModTime) {
+			lastSize, lastModTime = fi.Size(), fi.ModTime()
+			stableSince = time.Now()
+		} else if time.Since(stableSince) >= settle {
+			if !watch.SettleExclusive || canOpenExclusively(filePath) {
+				logInfo("File %s settled at %d bytes", filePath, lastSize)
+				return true
+			}
+		}
+
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			logError("Gave up waiting for %s to settle after %d ms", filePath, watch.SettleTimeout)
+			return false
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// appendEvery appends a byte to the file at each interval until stop is closed.
+func appendEvery(t *testing.T, path string, interval time.Duration, stop <-chan struct{}) <-chan time.Time {
+	lastWrite := make(chan time.Time, 1)
+	go func() {
+		var last time.Time
+		defer func() { lastWrite <- last }()
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer f.Close()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(interval):
+				f.Write([]byte("x"))
+				last = time.Now()
+			}
+		}
+	}()
+	return lastWrite
+}
+
+func TestWaitForStableFileWaitsForWritesToStop(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "upload.bin")
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	watch := &Watch{ID: "test"}
+	watch.Settle = 200
+
+	stop := make(chan struct{})
+	lastWrite := appendEvery(t, path, 20*time.Millisecond, stop)
+	time.AfterFunc(300*time.Millisecond, func() { close(stop) })
+
+	if !waitForStableFile(path, watch) {
+		t.Fatal("file did not settle")
+	}
+	if quiet := time.Since(<-lastWrite); quiet < 200*time.Millisecond {
+		t.Errorf("file settled %v after the last write, want at least the settle time", quiet)
+	}
+}
+
+func TestWaitForStableFileGivesUp(t *testing.T) {
+	dir := t.TempDir()
+
+	watch := &Watch{ID: "test"}
+	watch.Settle = 100
+	if waitForStableFile(filepath.Join(dir, "missing"), watch) {
+		t.Error("missing file settled")
+	}
+
+	path := filepath.Join(dir, "busy.bin")
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	appendEvery(t, path, 20*time.Millisecond, stop)
+
+	watch.SettleTimeout = 300
+	start := time.Now()
+	if waitForStableFile(path, watch) {
+		t.Error("file that never stops changing settled")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("gave up after %v, want about the settle timeout", elapsed)
+	}
+}
+
+func TestDispatchTaskMergesEventsWhileSettling(t *testing.T) {
+	taskQueue = make(chan *Task, 10)
+	defer func() { taskQueue = nil }()
+
+	root := t.TempDir()
+	watch := &Watch{ID: "test", TargetPath: root, root: root}
+	watch.Settle = 100
+	config := &Config{}
+	write := func(name string) string {
+		path := filepath.Join(root, name)
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	queued := func() []*Task {
+		time.Sleep(400 * time.Millisecond)
+		var tasks []*Task
+		for len(taskQueue) > 0 {
+			tasks = append(tasks, <-taskQueue)
+		}
+		return tasks
+	}
+
+	// A write while the new file settles stays a create
+	created := write("created.txt")
+	dispatchTask(newTask(watch, created, CreateEvent), watch, config)
+	dispatchTask(newTask(watch, created, WriteEvent), watch, config)
+	if tasks := queued(); len(tasks) != 1 || tasks[0].Event != CreateEvent {
+		t.Errorf("create and write queued %v, want one create", tasks)
+	}
+
+	// A file created and removed again while it settles runs nothing
+	gone := write("gone.txt")
+	dispatchTask(newTask(watch, gone, CreateEvent), watch, config)
+	dispatchTask(newTask(watch, gone, RemoveEvent), watch, config)
+	if tasks := queued(); len(tasks) != 0 {
+		t.Errorf("create and remove queued %v", tasks)
+	}
+
+	// A renamed file takes over the create held under its old name
+	oldPath := write("part.tmp")
+	dispatchTask(newTask(watch, oldPath, CreateEvent), watch, config)
+	newPath := write("final.txt")
+	rename := newTask(watch, newPath, RenameEvent)
+	rename.OldPath = oldPath
+	dispatchTask(rename, watch, config)
+	if tasks := queued(); len(tasks) != 1 || tasks[0].Event != CreateEvent || tasks[0].Path != newPath {
+		t.Errorf("create and rename queued %v, want one create of %s", tasks, newPath)
+	}
+}
@@ -0,0 +1,21 @@
+//go:build windows
+
+package main
+
+import "syscall"
+
+// canOpenExclusively reports whether the file can be opened without sharing,
+// which fails while another process still has it open.
+func canOpenExclusively(filePath string) bool {
+	pathPtr, err := syscall.UTF16PtrFromString(filePath)
+	if err != nil {
+		return false
+	}
+
+	handle, err := syscall.CreateFile(pathPtr, syscall.GENERIC_READ, 0, nil, syscall.OPEN_EXISTING, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err != nil {
+		return false
+	}
+	syscall.CloseHandle(handle)
+	return true
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Constants for state_compare values.
+const (
+	StateCompareMetadata = "metadata" // A file is unchanged if its size and modification time are the same
+	StateCompareHash     = "hash"     // A file is unchanged if its content hash is the same
+)
+
+// fileState is what the state store remembers about a successfully processed file.
+type fileState struct {
+	Size        int64     `json:"size"`
+	ModTime     time.Time `json:"mtime"`
+	Hash        string    `json:"hash,omitempty"`
+	Watch       string    `json:"watch"`
+	Event       EventType `json:"event"`
+	ProcessedAt time.Time `json:"processed_at"`
+}
+
+// stateSaveDelay is how long the state store collects changes before writing them to disk.
+const stateSaveDelay = time.Second
+
+// stateStore remembers which files were processed successfully, so that unchanged files
+// are not processed again after a restart or on duplicate events.
+type stateStore struct {
+	mu            sync.Mutex
+	path          string
+	compare       string
+	hashAlgorithm string
+	hashMaxSize   int64
+	files         map[string]fileState
+	saveTimer     *time.Timer // Pending write of changes, nil if there are none
+}
+
+// openStateStore loads the state store configured in config. A missing file is an empty store.
+func openStateStore(config *Config) (*stateStore, error) {
+	path := config.StatePath
+	s := &stateStore{
+		path:          path,
+		compare:       config.StateCompare,
+		hashAlgorithm: config.HashAlgorithm,
+		hashMaxSize:   config.HashMaxSize,
+		files:         make(map[string]fileState),
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading state file %s: %w", path, err)
+	}
+	if err := json.Unmarshal(data, &s.files); err != nil {
+		return nil, fmt.Errorf("error parsing state file %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// isUnchanged reports whether the file was processed before and has not changed since.
+// It is always false on a nil store.
+func (s *stateStore) isUnchanged(filePath string) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	previous, exists := s.files[filePath]
+	s.mu.Unlock()
+	if !exists {
+		return false
+	}
+
+	current, err := s.currentState(filePath)
+	if err != nil {
+		return false
+	}
+	if s.compare == StateCompareHash {
+		return current.Hash == previous.Hash
+	}
+	return current.Size == previous.Size && current.ModTime.Equal(previous.ModTime)
+}
+
+// recordProcessed remembers that the file of a task was processed successfully.
+// It is a no-op on a nil store.
+func (s *stateStore) recordProcessed(task *Task) {
+	if s == nil {
+		return
+	}
+
+	state, err := s.currentState(task.Path)
+	if err != nil {
+		logError("Error recording state of %s: %v", task.Path, err)
+		return
+	}
+	state.Watch = task.WatchID
+	state.Event = task.Event
+	state.ProcessedAt = time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[task.Path] = state
+	if task.OldPath != "" {
+		delete(s.files, task.OldPath)
+	}
+	s.scheduleSave()
+}
+
+// processedHash returns the content hash recorded when the file was last processed, or ""
+// if the store does not compare hashes. It is "" on a nil store.
+func (s *stateStore) processedHash(filePath string) string {
+	if s == nil {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.files[filePath].Hash
+}
+
+// forget removes the given paths from the store and returns how many were known.
+// It is a no-op on a nil store.
+func (s *stateStore) forget(paths ...string) int {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := 0
+	for _, path := range paths {
+		if _, exists := s.files[path]; exists {
+			delete(s.files, path)
+			removed++
+		}
+	}
+	if removed > 0 {
+		s.scheduleSave()
+	}
+	return removed
+}
+
+// reset removes every entry from the store and writes it to disk right away. It returns
+// how many entries were removed.
+func (s *stateStore) reset() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := len(s.files)
+	s.files = make(map[string]fileState)
+	if s.saveTimer != nil {
+		s.saveTimer.Stop()
+		s.saveTimer = nil
+	}
+	return count, s.save()
+}
+
+// entries returns a copy of the entries of the store. It is empty on a nil store.
+func (s *stateStore) entries() map[string]fileState {
+	entries := make(map[string]fileState)
+	if s == nil {
+		return entries
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for path, state := range s.files {
+		entries[path] = state
+	}
+	return entries
+}
+
+// currentState returns the size, modification time and, if configured, hash of a file.
+func (s *stateStore) currentState(filePath string) (fileState, error) {
+	fi, err := os.Stat(filePath)
+	if err != nil {
+		return fileState{}, err
+	}
+	state := fileState{Size: fi.Size(), ModTime: fi.ModTime()}
+	if s.compare == StateCompareHash {
+		if state.Hash, err = hashFile(filePath, s.hashAlgorithm, s.hashMaxSize); err != nil {
+			return fileState{}, err
+		}
+	}
+	return state, nil
+}
+
+// scheduleSave writes the store to disk after stateSaveDelay, together with every other
+// change made until then. The caller must hold s.mu.
+func (s *stateStore) scheduleSave() {
+	if s.saveTimer == nil {
+		s.saveTimer = time.AfterFunc(stateSaveDelay, s.flush)
+	}
+}
+
+// flush writes pending changes to disk. It is a no-op on a nil store.
+func (s *stateStore) flush() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.saveTimer == nil {
+		return
+	}
+	s.saveTimer.Stop()
+	s.saveTimer = nil
+	if err := s.save(); err != nil {
+		logError("Error saving state file: %v", err)
+	}
+}
+
+// save writes the store to disk, replacing the previous file atomically.
+// The caller must hold s.mu.
+func (s *stateStore) save() error {
+	data, err := json.MarshalIndent(s.files, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.path)
+}
+
+// runStateCommand implements the "state" command line: list, forget or reset the entries
+// of the state store. A running instance is asked through its admin API, so that it doesn't
+// overwrite the changes with its own copy; otherwise the state file is used directly.
+// It returns the process exit code.
+func runStateCommand(config *Config, args []string) int {
+	if config.StatePath == "" {
+		fmt.Fprintln(os.Stderr, "state_path is not set in the configuration")
+		return 1
+	}
+	if len(args) == 0 {
+		args = []string{"list"}
+	}
+
+	var paths []string
+	switch args[0] {
+	case "list", "ls", "reset":
+	case "forget":
+		if len(args) < 2 {
+			fmt.Fprintln(os.Stderr, "usage: state forget <path>...")
+			return 2
+		}
+		for _, path := range args[1:] {
+			if absPath, err := filepath.Abs(path); err == nil {
+				path = absPath
+			}
+			paths = append(paths, path)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown state command %q (use list, forget or reset)\n", args[0])
+		return 2
+	}
+
+	result, err := stateCommandOnInstance(config, args[0], paths)
+	if errors.Is(err, errNoInstance) {
+		result, err = stateCommandOnFile(config, args[0], paths)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	switch args[0] {
+	case "forget":
+		fmt.Printf("Forgot %d of %d paths\n", result.Forgotten, len(paths))
+	case "reset":
+		fmt.Printf("Removed %d entries\n", result.Removed)
+	default:
+		printStateEntries(result.Entries)
+	}
+	return 0
+}
+
+// stateResult is the response of the state requests of the admin API.
+type stateResult struct {
+	Entries   map[string]fileState `json:"entries,omitempty"`
+	Forgotten int                  `json:"forgotten"`
+	Removed   int                  `json:"removed"`
+}
+
+// stateCommandOnInstance runs a state command on the running instance. It returns
+// errNoInstance if no admin API is configured or no instance is listening on it.
+func stateCommandOnInstance(config *Config, command string, paths []string) (*stateResult, error) {
+	client, err := newAdminClient(config)
+	if err != nil {
+		return nil, errNoInstance
+	}
+
+	var data []byte
+	switch command {
+	case "forget":
+		data, err = client.do(http.MethodPost, "/state/forget", &adminRequest{Paths: paths})
+	case "reset":
+		data, err = client.do(http.MethodPost, "/state/reset", nil)
+	default:
+		data, err = client.do(http.MethodGet, "/state", nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var result stateResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("error reading response: %w", err)
+	}
+	return &result, nil
+}
+
+// stateCommandOnFile runs a state command on the state file, when no instance is running.
+func stateCommandOnFile(config *Config, command string, paths []string) (*stateResult, error) {
+	store, err := openStateStore(config)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &stateResult{}
+	switch command {
+	case "forget":
+		result.Forgotten = store.forget(paths...)
+		store.flush()
+	case "reset":
+		if result.Removed, err = store.reset(); err != nil {
+			return nil, fmt.Errorf("error saving state file: %w", err)
+		}
+	default:
+		result.Entries = store.entries()
+	}
+	return result, nil
+}
+
+// printStateEntries prints the entries of the state store, sorted by path.
+func printStateEntries(entries map[string]fileState) {
+	paths := make([]string, 0, len(entries))
+	for path := range entries {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PATH\tSIZE\tMODIFIED\tPROCESSED\tWATCH")
+	for _, path := range paths {
+		state := entries[path]
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", path, state.Size,
+			state.ModTime.Format(time.RFC3339), state.ProcessedAt.Format(time.RFC3339), state.Watch)
+	}
+	w.Flush()
+}
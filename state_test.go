@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFileAt(t *testing.T, path, content string, mtime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStateStoreCompare(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.csv")
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	for _, compare := range []string{StateCompareMetadata, StateCompareHash} {
+		store, err := openStateStore(&Config{StatePath: filepath.Join(dir, compare+".json"), StateCompare: compare, HashAlgorithm: HashAlgorithmSHA256})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.flush()
+		writeFileAt(t, path, "a,b", mtime)
+		if store.isUnchanged(path) {
+			t.Errorf("%s: unknown file is unchanged", compare)
+		}
+		store.recordProcessed(&Task{Path: path, Event: CreateEvent, WatchID: "w"})
+		if !store.isUnchanged(path) {
+			t.Errorf("%s: processed file is not unchanged", compare)
+		}
+
+		// Touched, same content
+		writeFileAt(t, path, "a,b", mtime.Add(time.Minute))
+		if got, want := store.isUnchanged(path), compare == StateCompareHash; got != want {
+			t.Errorf("%s: touched file unchanged = %v, want %v", compare, got, want)
+		}
+
+		// Same size and time, different content
+		writeFileAt(t, path, "c,d", mtime)
+		if got, want := store.isUnchanged(path), compare == StateCompareMetadata; got != want {
+			t.Errorf("%s: rewritten file unchanged = %v, want %v", compare, got, want)
+		}
+	}
+}
+
+func TestStateStorePersistsAndForgets(t *testing.T) {
+	dir := t.TempDir()
+	statePath := filepath.Join(dir, "state.json")
+	oldPath := filepath.Join(dir, "a.tmp")
+	path := filepath.Join(dir, "a.csv")
+	other := filepath.Join(dir, "b.csv")
+	mtime := time.Now().Add(-time.Hour)
+	writeFileAt(t, oldPath, "old", mtime)
+	writeFileAt(t, path, "new", mtime)
+	writeFileAt(t, other, "other", mtime)
+
+	config := &Config{StatePath: statePath, StateCompare: StateCompareMetadata}
+	store, err := openStateStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.recordProcessed(&Task{Path: oldPath, Event: CreateEvent, WatchID: "w"})
+	store.recordProcessed(&Task{Path: path, OldPath: oldPath, Event: RenameEvent, WatchID: "w"})
+	store.recordProcessed(&Task{Path: other, Event: CreateEvent, WatchID: "w"})
+
+	// Changes are collected and written together
+	if _, err := os.Stat(statePath); !os.IsNotExist(err) {
+		t.Errorf("state file written before the save delay: %v", err)
+	}
+	store.flush()
+
+	reopened, err := openStateStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reopened.files) != 2 {
+		t.Fatalf("reopened store has %d entries, want 2: %v", len(reopened.files), reopened.files)
+	}
+	if reopened.isUnchanged(oldPath) {
+		t.Error("old path of a renamed file is still remembered")
+	}
+	if !reopened.isUnchanged(path) || reopened.files[path].Event != RenameEvent {
+		t.Errorf("renamed file not remembered: %+v", reopened.files[path])
+	}
+
+	if n := reopened.forget(path, filepath.Join(dir, "unknown")); n != 1 {
+		t.Errorf("forget removed %d entries, want 1", n)
+	}
+	if reopened.isUnchanged(path) {
+		t.Error("forgotten file is still unchanged")
+	}
+
+	if n, err := reopened.reset(); err != nil || n != 1 {
+		t.Errorf("reset = %d, %v, want 1 entry removed", n, err)
+	}
+	if reset, _ := openStateStore(config); len(reset.files) != 0 {
+		t.Errorf("state file still has %d entries after a reset", len(reset.files))
+	}
+
+	var nilStore *stateStore
+	nilStore.recordProcessed(&Task{Path: path})
+	nilStore.flush()
+	if nilStore.isUnchanged(path) || nilStore.forget(path) != 0 || len(nilStore.entries()) != 0 {
+		t.Error("nil store remembered a file")
+	}
+}
+
+func TestHandleStateForget(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.csv")
+	writeFileAt(t, path, "a", time.Now())
+
+	forget := func(body string) (int, stateResult) {
+		rec := httptest.NewRecorder()
+		handleStateForget(rec, httptest.NewRequest("POST", "/state/forget", strings.NewReader(body)))
+		var result stateResult
+		json.Unmarshal(rec.Body.Bytes(), &result)
+		return rec.Code, result
+	}
+
+	if code, _ := forget(`{"paths":["x"]}`); code != http.StatusConflict {
+		t.Errorf("forget without a state store: status %d, want %d", code, http.StatusConflict)
+	}
+
+	store, err := openStateStore(&Config{StatePath: filepath.Join(dir, "state.json"), StateCompare: StateCompareMetadata})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.flush()
+	store.recordProcessed(&Task{Path: path, Event: CreateEvent, WatchID: "w"})
+	stateDB = store
+	defer func() { stateDB = nil }()
+
+	body, _ := json.Marshal(adminRequest{Paths: []string{path, filepath.Join(dir, "unknown")}})
+	if code, result := forget(string(body)); code != http.StatusOK || result.Forgotten != 1 {
+		t.Errorf("forget: status %d, %+v", code, result)
+	}
+	if store.isUnchanged(path) {
+		t.Error("file is still remembered after forget")
+	}
+}
+
+func TestFinishFileRecordsStateAfterPostProcessing(t *testing.T) {
+	dir := t.TempDir()
+	store, err := openStateStore(&Config{StatePath: filepath.Join(dir, "state.json"), StateCompare: StateCompareMetadata})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.flush()
+	stateDB = store
+	defer func() { stateDB = nil }()
+
+	finish := func(name string, postProcess int) (string, error) {
+		path := filepath.Join(dir, name)
+		writeFileAt(t, path, name, time.Now())
+		watch := &Watch{ID: "w", ProcessedPath: filepath.Join(dir, "done"), PostProcessAction: postProcess}
+		return path, finishFile(&Task{Path: path, Event: CreateEvent, WatchID: "w"}, watch)
+	}
+
+	kept, err := finish("kept.csv", PostProcessActionDoNothing)
+	if err != nil || !store.isUnchanged(kept) {
+		t.Errorf("file left in place was not recorded (%v)", err)
+	}
+
+	// A file moved away is forgotten, even if an earlier run left it in place
+	moved := filepath.Join(dir, "moved.csv")
+	writeFileAt(t, moved, "moved.csv", time.Now())
+	store.recordProcessed(&Task{Path: moved, Event: CreateEvent, WatchID: "w"})
+	if _, err := finish("moved.csv", PostProcessActionMove); err != nil {
+		t.Fatal(err)
+	}
+	if _, known := store.entries()[moved]; known {
+		t.Error("file moved by post_process is still recorded")
+	}
+
+	failed, err := finish("failed.csv", 7)
+	if err == nil {
+		t.Fatal("invalid post_process succeeded")
+	}
+	if _, known := store.entries()[failed]; known {
+		t.Error("file whose post-processing failed was recorded")
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// Task is a unit of work passed from the event handlers to the worker pool.
+type Task struct {
+	ID        string    `json:"id"`                  // Correlation id, used to follow a task through the logs
+	Path      string    `json:"path"`                // File the event is about
+	OldPath   string    `json:"old_path,omitempty"`  // Previous path of a renamed file, if known
+	Event     EventType `json:"event"`               // Event that triggered the task
+	WatchID   string    `json:"watch_id"`            // Watch the file belongs to
+	Timestamp time.Time `json:"timestamp"`           // When the event was received
+	Attempt   int       `json:"attempt"`             // Number of processing attempts made so far
+	Hash      string    `json:"hash,omitempty"`      // Content hash computed when the task was queued, if enabled
+	Batch     []*Task   `json:"batch,omitempty"`     // Files of a batch task; Path is then the first of them
+	Partition string    `json:"partition,omitempty"` // Tasks with the same partition are processed in order
+	Force     bool      `json:"force,omitempty"`     // Process the file even if it is unchanged since it was last processed
+	WorkerID  int       `json:"-"`                   // Worker processing the task, 0 while it is queued
+
+	retryAction  int             // Index of the action to continue with when a failed command is retried
+	retryHistory []attemptRecord // Attempts made so far by the command being retried
+}
+
+// newTask creates a task for an event on a file of the given watch.
+func newTask(watch *Watch, path string, eventType EventType) *Task {
+	return &Task{
+		ID:        newTaskID(),
+		Path:      path,
+		Event:     eventType,
+		WatchID:   watch.ID,
+		Timestamp: time.Now(),
+		Partition: partitionKey(watch, path),
+	}
+}
+
+// newTaskID returns a short random identifier for a task.
+func newTaskID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		// Fall back to the clock; uniqueness only matters for log correlation
+		return fmt.Sprintf("%016x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// files returns the single-file tasks a task stands for: its batch, or the task itself.
+func (t *Task) files() []*Task {
+	if len(t.Batch) > 0 {
+		return t.Batch
+	}
+	return []*Task{t}
+}
+
+// String describes the task for log messages.
+func (t *Task) String() string {
+	if len(t.Batch) > 0 {
+		return fmt.Sprintf("%d files from %s (%s batch, task %s)", len(t.Batch), t.Path, t.Event, t.ID)
+	}
+	if t.OldPath != "" {
+		return fmt.Sprintf("%s -> %s (%s, task %s)", t.OldPath, t.Path, t.Event, t.ID)
+	}
+	return fmt.Sprintf("%s (%s, task %s)", t.Path, t.Event, t.ID)
+}
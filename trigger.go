@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var (
+	manifestCache      = make(map[manifestDir]map[string][]string) // Listed paths by manifest, per directory
+	manifestCacheMutex sync.Mutex
+)
+
+// manifestDir identifies the manifests matching a glob in one directory.
+type manifestDir struct {
+	dir  string
+	glob string
+}
+
+// TriggerOptions make a watch process a data file only once a companion file says it is
+// complete: a marker next to it (e.g. batch.csv.done) or a manifest listing it.
+type TriggerOptions struct {
+	Markers  []string `yaml:"markers,omitempty"`  // Suffixes appended to the data file name, e.g. ".done", ".ok", ".md5"
+	Manifest string   `yaml:"manifest,omitempty"` // Glob of manifest file names, e.g. "*.manifest"
+}
+
+// enabled reports whether data files wait for a marker or manifest.
+func (t *TriggerOptions) enabled() bool {
+	return len(t.Markers) > 0 || t.Manifest != ""
+}
+
+// validate checks the trigger settings of a watch.
+func (t *TriggerOptions) validate() error {
+	for _, suffix := range t.Markers {
+		if suffix == "" {
+			return fmt.Errorf("empty marker suffix")
+		}
+	}
+	if t.Manifest != "" {
+		if _, err := filepath.Match(t.Manifest, ""); err != nil {
+			return fmt.Errorf("invalid manifest glob %q: %w", t.Manifest, err)
+		}
+	}
+	return nil
+}
+
+// isTriggerFile reports whether path is a marker or manifest of the watch rather than a data file.
+func isTriggerFile(path string, watch *Watch) bool {
+	return markerSuffix(path, watch) != "" || isManifest(path, watch)
+}
+
+// markerSuffix returns the marker suffix path ends with, or "".
+func markerSuffix(path string, watch *Watch) string {
+	name := filepath.Base(path)
+	for _, suffix := range watch.Trigger.Markers {
+		if len(name) > len(suffix) && strings.HasSuffix(name, suffix) {
+			return suffix
+		}
+	}
+	return ""
+}
+
+// isManifest reports whether path is a manifest of the watch.
+func isManifest(path string, watch *Watch) bool {
+	if watch.Trigger.Manifest == "" {
+		return false
+	}
+	matched, _ := filepath.Match(watch.Trigger.Manifest, filepath.Base(path))
+	return matched
+}
+
+// handleTriggerFile queues the data files a marker or manifest that just appeared stands for.
+func handleTriggerFile(path string, watch *Watch, config *Config) {
+	if _, err := os.Stat(path); err != nil {
+		return // Removed, or moved away
+	}
+
+	if suffix := markerSuffix(path, watch); suffix != "" {
+		queueTriggeredFile(strings.TrimSuffix(path, suffix), watch, config)
+		return
+	}
+
+	listed, err := readManifest(path, watch)
+	if err != nil {
+		logError("Error reading manifest %s: %v", path, err)
+		return
+	}
+	logInfo("Manifest %s lists %d files", path, len(listed))
+	for _, dataPath := range listed {
+		queueTriggeredFile(dataPath, watch, config)
+	}
+}
+
+// queueTriggeredFile queues a data file whose marker or manifest has appeared.
+func queueTriggeredFile(dataPath string, watch *Watch, config *Config) {
+	if !isWithinRoot(dataPath, watch.root) {
+		logError("Not queuing %s: not within %s", dataPath, watch.TargetPath)
+		return
+	}
+	fi, err := os.Stat(dataPath)
+	if err != nil {
+		logError("Marker or manifest found, but data file %s is missing", dataPath)
+		return
+	}
+	if !fi.Mode().IsRegular() || isExcludedPath(dataPath, watch) || !isIncludedFile(dataPath, watch) {
+		return
+	}
+	logInfo("Data file is complete: %s", dataPath)
+	submitTask(newTask(watch, dataPath, CreateEvent), watch, config)
+}
+
+// triggerReady reports whether a data file may be processed: always when the watch has no
+// trigger settings, otherwise once one of its markers exists or a manifest lists it.
+// Checksum markers are only verified by the worker, see verifyTrigger.
+func triggerReady(dataPath string, watch *Watch) bool {
+	if !watch.Trigger.enabled() {
+		return true
+	}
+
+	for _, suffix := range watch.Trigger.Markers {
+		if _, err := os.Stat(dataPath + suffix); err == nil {
+			return true
+		}
+	}
+	return len(manifestsListing(dataPath, watch)) > 0
+}
+
+// verifyTrigger checks that a data file released by a checksum marker matches it. A file
+// is fine if any of its markers matches or isn't a checksum, or if a manifest lists it.
+func verifyTrigger(dataPath string, watch *Watch) error {
+	if !watch.Trigger.enabled() {
+		return nil
+	}
+
+	var mismatch error
+	for _, suffix := range watch.Trigger.Markers {
+		markerPath := dataPath + suffix
+		if _, err := os.Stat(markerPath); err != nil {
+			continue
+		}
+		if err := verifyChecksumMarker(dataPath, markerPath); err != nil {
+			mismatch = fmt.Errorf("marker %s does not match: %w", markerPath, err)
+			continue
+		}
+		return nil
+	}
+	if mismatch != nil && len(manifestsListing(dataPath, watch)) == 0 {
+		return mismatch
+	}
+	return nil
+}
+
+// verifyChecksumMarker compares a data file with the checksum in a .md5 or .sha256 marker.
+// Other markers, and checksum markers that are empty, are not checked.
+func verifyChecksumMarker(dataPath, markerPath string) error {
+	var algorithm string
+	switch strings.ToLower(filepath.Ext(markerPath)) {
+	case ".md5":
+		algorithm = "md5"
+	case ".sha256":
+		algorithm = HashAlgorithmSHA256
+	default:
+		return nil
+	}
+
+	data, err := os.ReadFile(markerPath)
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(string(data)) // "<checksum>  <file name>" as written by md5sum
+	if len(fields) == 0 {
+		return nil
+	}
+	expected := strings.ToLower(fields[0])
+
+	var actual string
+	if algorithm == "md5" {
+		actual, err = md5File(dataPath)
+	} else {
+		actual, err = hashFile(dataPath, algorithm, 0)
+	}
+	if err != nil {
+		return err
+	}
+	if actual != expected {
+		return fmt.Errorf("checksum is %s, expected %s", actual, expected)
+	}
+	return nil
+}
+
+// md5File returns the hex encoded MD5 of a file's content.
+func md5File(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// readManifest returns the absolute paths of the files a manifest lists, one per line,
+// relative to the manifest's directory. Blank lines and lines starting with # are skipped,
+// and so are files outside the watch root, which a manifest must not hand to the commands.
+func readManifest(manifestPath string, watch *Watch) ([]string, error) {
+	f, err := os.Open(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var listed []string
+	dir := filepath.Dir(manifestPath)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		path := filepath.Join(dir, filepath.FromSlash(line))
+		if !isWithinRoot(path, watch.root) {
+			logError("Ignoring %s listed by manifest %s: not within %s", line, manifestPath, watch.TargetPath)
+			continue
+		}
+		listed = append(listed, path)
+	}
+	return listed, scanner.Err()
+}
+
+// manifestsListing returns the manifests that list dataPath. Manifests are looked for in the
+// directory of the data file and every directory above it up to the watch root.
+func manifestsListing(dataPath string, watch *Watch) []string {
+	if watch.Trigger.Manifest == "" {
+		return nil
+	}
+
+	var manifests []string
+	for dir := filepath.Dir(dataPath); isWithinRoot(dir, watch.root); dir = filepath.Dir(dir) {
+		for manifestPath, listed := range loadManifests(dir, watch) {
+			for _, path := range listed {
+				if path == dataPath {
+					manifests = append(manifests, manifestPath)
+					break
+				}
+			}
+		}
+		if dir == watch.root {
+			break
+		}
+	}
+	return manifests
+}
+
+// loadManifests returns the paths listed by each manifest of the watch in dir. Manifests
+// are read once and kept until forgetManifests is called for their directory.
+func loadManifests(dir string, watch *Watch) map[string][]string {
+	manifestCacheMutex.Lock()
+	defer manifestCacheMutex.Unlock()
+
+	key := manifestDir{dir: dir, glob: watch.Trigger.Manifest}
+	if manifests, ok := manifestCache[key]; ok {
+		return manifests
+	}
+
+	manifests := make(map[string][]string)
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		manifestPath := filepath.Join(dir, entry.Name())
+		if entry.IsDir() || !isManifest(manifestPath, watch) {
+			continue
+		}
+		listed, err := readManifest(manifestPath, watch)
+		if err != nil {
+			logError("Error reading manifest %s: %v", manifestPath, err)
+			continue
+		}
+		manifests[manifestPath] = listed
+	}
+	manifestCache[key] = manifests
+	return manifests
+}
+
+// forgetManifests drops the cached manifests of dir and every directory below it, so they
+// are read again the next time they are needed.
+func forgetManifests(dir string) {
+	manifestCacheMutex.Lock()
+	defer manifestCacheMutex.Unlock()
+
+	for cached := range manifestCache {
+		if isWithinRoot(cached.dir, dir) {
+			delete(manifestCache, cached)
+		}
+	}
+}
+
+// cleanupTriggerFiles applies the post-processing of a data file to its markers, and to
+// manifests listing it once none of the files they list are left.
+func cleanupTriggerFiles(dataPath string, watch *Watch) {
+	if !watch.Trigger.enabled() || watch.PostProcessAction == PostProcessActionDoNothing {
+		return
+	}
+
+	var done []string
+	for _, suffix := range watch.Trigger.Markers {
+		if _, err := os.Stat(dataPath + suffix); err == nil {
+			done = append(done, dataPath+suffix)
+		}
+	}
+	for _, manifestPath := range manifestsListing(dataPath, watch) {
+		listed, _ := readManifest(manifestPath, watch)
+		remaining := 0
+		for _, path := range listed {
+			if _, err := os.Stat(path); err == nil {
+				remaining++
+			}
+		}
+		if remaining == 0 {
+			done = append(done, manifestPath)
+		}
+	}
+
+	for _, path := range done {
+		if err := handlePostProcessing(path, watch); err != nil {
+			logError("Error cleaning up %s: %v", path, err)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// triggerWatch returns a watch on root with the given trigger settings.
+func triggerWatch(root string, trigger TriggerOptions) *Watch {
+	watch := &Watch{ID: "test", TargetPath: root, root: root, OnCreateRun: []string{"echo"}}
+	watch.Trigger = trigger
+	return watch
+}
+
+func writeFiles(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTriggerReadyWithMarkers(t *testing.T) {
+	root := t.TempDir()
+	watch := triggerWatch(root, TriggerOptions{Markers: []string{".done", ".md5"}})
+	writeFiles(t, root, map[string]string{
+		"waiting.csv":   "a",
+		"done.csv":      "a",
+		"done.csv.done": "",
+		"good.csv":      "abc",
+		"good.csv.md5":  "900150983cd24fb0d6963f7d28e17f72  good.csv\n",
+		"bad.csv":       "abc",
+		"bad.csv.md5":   "00000000000000000000000000000000  bad.csv\n",
+		"empty.csv":     "abc",
+		"empty.csv.md5": "",
+	})
+
+	// Any marker releases a file, the worker checks the checksums
+	tests := map[string]struct{ ready, verified bool }{
+		"waiting.csv": {false, true},
+		"done.csv":    {true, true},
+		"good.csv":    {true, true},
+		"bad.csv":     {true, false},
+		"empty.csv":   {true, true},
+	}
+	for name, want := range tests {
+		path := filepath.Join(root, name)
+		if got := triggerReady(path, watch); got != want.ready {
+			t.Errorf("triggerReady(%s) = %v, want %v", name, got, want.ready)
+		}
+		if err := verifyTrigger(path, watch); (err == nil) != want.verified {
+			t.Errorf("verifyTrigger(%s) = %v, want verified %v", name, err, want.verified)
+		}
+	}
+
+	if !isTriggerFile(filepath.Join(root, "done.csv.done"), watch) || isTriggerFile(filepath.Join(root, "done.csv"), watch) {
+		t.Error("isTriggerFile does not tell markers from data files")
+	}
+	if !triggerReady(filepath.Join(root, "waiting.csv"), triggerWatch(root, TriggerOptions{})) {
+		t.Error("file is held by a watch without trigger settings")
+	}
+}
+
+func TestReadManifest(t *testing.T) {
+	root := t.TempDir()
+	watch := triggerWatch(filepath.Join(root, "in"), TriggerOptions{Manifest: "*.manifest"})
+	writeFiles(t, root, map[string]string{
+		"in/batch.manifest": "# files of batch 7\n\na.csv\n  sub/b.csv  \n../secret.txt\nsub/../../in2/c.csv\n",
+	})
+	listed, err := readManifest(filepath.Join(root, "in", "batch.manifest"), watch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filepath.Join(root, "in", "a.csv"), filepath.Join(root, "in", "sub", "b.csv")}
+	if !slices.Equal(listed, want) {
+		t.Errorf("readManifest = %q, want %q without the files outside the watch root", listed, want)
+	}
+}
+
+func TestTriggerReadyWithManifest(t *testing.T) {
+	root := t.TempDir()
+	watch := triggerWatch(root, TriggerOptions{Manifest: "*.manifest"})
+	writeFiles(t, root, map[string]string{
+		"day1/listed.csv":    "a",
+		"day1/unlisted.csv":  "b",
+		"day1/sub/deep.csv":  "c",
+		"day1.manifest":      "day1/listed.csv\n",
+		"day1/day1.manifest": "sub/deep.csv\n",
+	})
+
+	if !triggerReady(filepath.Join(root, "day1", "listed.csv"), watch) {
+		t.Error("file listed by a manifest in a parent directory is not ready")
+	}
+	if !triggerReady(filepath.Join(root, "day1", "sub", "deep.csv"), watch) {
+		t.Error("file listed by a manifest in its parent directory is not ready")
+	}
+	if triggerReady(filepath.Join(root, "day1", "unlisted.csv"), watch) {
+		t.Error("file no manifest lists is ready")
+	}
+}
+
+func TestManifestCache(t *testing.T) {
+	root := t.TempDir()
+	watch := triggerWatch(root, TriggerOptions{Manifest: "*.manifest"})
+	writeFiles(t, root, map[string]string{
+		"a.csv":          "a",
+		"b.csv":          "b",
+		"batch.manifest": "a.csv\n",
+	})
+	b := filepath.Join(root, "b.csv")
+
+	if triggerReady(b, watch) {
+		t.Fatal("unlisted file is ready")
+	}
+	writeFiles(t, root, map[string]string{"batch.manifest": "a.csv\nb.csv\n"})
+	if triggerReady(b, watch) {
+		t.Error("manifest was read again before it was forgotten")
+	}
+	forgetManifests(root)
+	if !triggerReady(b, watch) {
+		t.Error("changed manifest was not read again after it was forgotten")
+	}
+}
+
+func TestHandleTriggerFileQueuesListedFiles(t *testing.T) {
+	taskQueue = make(chan *Task, 10)
+	defer func() { taskQueue = nil }()
+
+	dir := t.TempDir()
+	root := filepath.Join(dir, "in")
+	watch := triggerWatch(root, TriggerOptions{Manifest: "*.manifest"})
+	writeFiles(t, dir, map[string]string{
+		"in/a.csv":          "a",
+		"in/batch.manifest": "a.csv\nmissing.csv\n../outside.csv\n",
+		"outside.csv":       "secret",
+	})
+	config := &Config{DebounceMode: DebounceModeLeading}
+
+	handleTriggerFile(filepath.Join(root, "batch.manifest"), watch, config)
+	queueTriggeredFile(filepath.Join(dir, "outside.csv"), watch, config)
+
+	if len(taskQueue) != 1 {
+		t.Fatalf("%d tasks queued, want 1", len(taskQueue))
+	}
+	if task := <-taskQueue; task.Path != filepath.Join(root, "a.csv") || task.Event != CreateEvent {
+		t.Errorf("queued %s, want a create of a.csv", task)
+	}
+}
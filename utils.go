@@ -1,38 +1,59 @@
 package main
 
 import (
+	"context"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"syscall"
+	"time"
 )
 
-// isExcludedPath checks if a given path should be excluded based on the config.
-func isExcludedPath(path string, config *Config) bool {
+// isExcludedPath checks if a given path should be excluded based on the exclude_path
+// patterns of the watch and the ignore files in its tree.
+func isExcludedPath(path string, watch *Watch) bool {
 	// Convert the path to an absolute path
 	absPath, err := filepath.Abs(path)
 	if err != nil {
-		logger.Printf("Error getting absolute path for %s: %v", path, err)
+		logError("Error getting absolute path for %s: %v", path, err)
 		return false // Don't exclude if we can't get the absolute path
 	}
 
-	for _, excludePattern := range config.ExcludePaths {
-		// Remove * and trim spaces from the exclude pattern
-		cleanedExcludePattern := strings.TrimSpace(strings.ReplaceAll(excludePattern, "*", ""))
+	return watch.excludes.matches(absPath, watch.root) || isIgnoredByFiles(absPath, watch)
+}
 
-		// Exact Path Match (case-insensitive)
-		if strings.EqualFold(absPath, cleanedExcludePattern) {
-			return true
-		}
+// isIncludedFile checks if a file passes the file_type and include_path filters of the watch.
+func isIncludedFile(path string, watch *Watch) bool {
+	if !isAllowedFileType(path, watch.FileTypes) {
+		return false
+	}
+	if watch.includes == nil {
+		return true // No include_path means every file
+	}
 
-		// Substring Match (case-insensitive)
-		if strings.Contains(strings.ToLower(absPath), strings.ToLower(cleanedExcludePattern)) {
-			return true
-		}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		logError("Error getting absolute path for %s: %v", path, err)
+		return false
 	}
+	return watch.includes.matches(absPath, watch.root)
+}
 
-	return false
+// isWithinRoot reports whether absPath is root itself or lies somewhere below it.
+func isWithinRoot(absPath, root string) bool {
+	if root == "" {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		absPath = strings.ToLower(absPath)
+		root = strings.ToLower(root)
+	}
+	if absPath == root {
+		return true
+	}
+	return strings.HasPrefix(absPath, strings.TrimSuffix(root, string(filepath.Separator))+string(filepath.Separator))
 }
 
 // isAllowedFileType checks if the file extension is in the allowed list
@@ -58,8 +79,10 @@ func setupSignalHandling(config *Config) {
 
 	go func() {
 		sig := <-sigCh
-		logger.Printf("Received signal: %v. Shutting down...", sig)
+		logInfo("Received signal: %v. Shutting down...", sig)
 		executeShutdownCommand(config)
+		stateDB.flush()
+		removeAdminSocket()
 		os.Exit(0)
 	}()
 }
@@ -67,9 +90,9 @@ func setupSignalHandling(config *Config) {
 // executeStartupCommand executes the initialization command if specified in the config.
 func executeStartupCommand(config *Config) {
 	if len(config.InitRun) > 0 {
-		logger.Println("Executing initialization command...")
-		if err := executeCommand(config.InitRun, ""); err != nil {
-			logger.Fatalf("Error executing initialization command: %v", err)
+		logInfo("Executing initialization command...")
+		if err := executeCommandWithOptions(context.Background(), config.InitRun, "", lifecycleCommandOptions(config, config.InitEnv)); err != nil {
+			logFatal("Error executing initialization command: %v", err)
 		}
 	}
 }
@@ -77,9 +100,18 @@ func executeStartupCommand(config *Config) {
 // executeShutdownCommand executes the termination command if specified in the config.
 func executeShutdownCommand(config *Config) {
 	if len(config.ExitRun) > 0 {
-		logger.Println("Executing termination command...")
-		if err := executeCommand(config.ExitRun, ""); err != nil {
-			logger.Printf("Error executing termination command: %v", err)
+		logInfo("Executing termination command...")
+		if err := executeCommandWithOptions(context.Background(), config.ExitRun, "", lifecycleCommandOptions(config, config.ExitEnv)); err != nil {
+			logError("Error executing termination command: %v", err)
 		}
 	}
 }
+
+// lifecycleCommandOptions returns the run settings of init_run and exit_run.
+func lifecycleCommandOptions(config *Config, env map[string]string) commandOptions {
+	return commandOptions{
+		KillGrace: time.Duration(config.KillGrace) * time.Millisecond,
+		Env:       append(expandEnv(config.Env), expandEnv(env)...),
+		DryRun:    config.DryRun,
+	}
+}
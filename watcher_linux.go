@@ -0,0 +1,91 @@
+//go:build linux
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rjeczalik/notify"
+	"golang.org/x/sys/unix"
+)
+
+// watchedEvents are the events registered for every watch. On Linux, moves are watched
+// through the inotify events so the old and new path of a rename can be paired up.
+var watchedEvents = []notify.Event{notify.Create, notify.Write, notify.Remove, notify.InMovedFrom, notify.InMovedTo}
+
+// movePairTimeout is how long one half of a rename waits for the other half before the
+// file is considered moved out of or into the watched tree.
+const movePairTimeout = 200 * time.Millisecond
+
+var (
+	pendingMoves      = make(map[uint32]*pendingMove)
+	pendingMovesMutex sync.Mutex
+)
+
+// pendingMove is one half of a rename, waiting for the other half with the same cookie.
+type pendingMove struct {
+	path     string
+	watch    *Watch
+	movedOut bool // true for IN_MOVED_FROM, false for IN_MOVED_TO
+	timer    *time.Timer
+}
+
+// isMoveEvent reports whether a create event was caused by a file being moved into place.
+// Such events are also delivered as notify.InMovedTo and handled there.
+func isMoveEvent(event notify.EventInfo) bool {
+	sys, ok := event.Sys().(*unix.InotifyEvent)
+	return ok && sys.Mask&unix.IN_MOVED_TO != 0
+}
+
+// handleMoveEvent pairs inotify IN_MOVED_FROM and IN_MOVED_TO events by their cookie into a
+// single rename with both paths. The halves may arrive in either order. A half that stays
+// unpaired is a file moved out of or into the tree, reported as remove or create.
+func handleMoveEvent(event notify.EventInfo, watch *Watch, config *Config, watcherChannel chan notify.EventInfo) {
+	sys, ok := event.Sys().(*unix.InotifyEvent)
+	if !ok || (event.Event() != notify.InMovedFrom && event.Event() != notify.InMovedTo) {
+		return
+	}
+	move := &pendingMove{path: event.Path(), watch: watch, movedOut: event.Event() == notify.InMovedFrom}
+
+	pendingMovesMutex.Lock()
+	other, paired := pendingMoves[sys.Cookie]
+	if paired && other.movedOut != move.movedOut {
+		other.timer.Stop()
+		delete(pendingMoves, sys.Cookie)
+		pendingMovesMutex.Unlock()
+
+		from, to := other, move
+		if move.movedOut {
+			from, to = move, other
+		}
+		if from.watch != to.watch {
+			// Moved between two watches: it leaves one and arrives in the other
+			handleRemoveEvent(from.path, from.watch, config)
+			handleCreateEvent(to.path, to.watch, config, watcherChannel)
+			return
+		}
+		handleRenameEvent(to.path, from.path, to.watch, config, watcherChannel)
+		return
+	}
+
+	move.timer = time.AfterFunc(movePairTimeout, func() {
+		pendingMovesMutex.Lock()
+		if pendingMoves[sys.Cookie] != move {
+			pendingMovesMutex.Unlock()
+			return
+		}
+		delete(pendingMoves, sys.Cookie)
+		pendingMovesMutex.Unlock()
+
+		if move.movedOut {
+			logInfo("File or directory moved out of the watched tree: %s", move.path)
+			handleRemoveEvent(move.path, move.watch, config)
+		} else {
+			logInfo("File or directory moved into the watched tree: %s", move.path)
+			handleCreateEvent(move.path, move.watch, config, watcherChannel)
+		}
+	})
+	pendingMoves[sys.Cookie] = move
+	pendingMovesMutex.Unlock()
+}
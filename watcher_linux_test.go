@@ -0,0 +1,79 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rjeczalik/notify"
+	"golang.org/x/sys/unix"
+)
+
+// moveEvent is an inotify move event as delivered by notify.
+type moveEvent struct {
+	event  notify.Event
+	path   string
+	cookie uint32
+}
+
+func (e moveEvent) Event() notify.Event { return e.event }
+func (e moveEvent) Path() string        { return e.path }
+func (e moveEvent) Sys() interface{}    { return &unix.InotifyEvent{Cookie: e.cookie} }
+
+func receiveTask(t *testing.T) *Task {
+	t.Helper()
+	select {
+	case task := <-taskQueue:
+		return task
+	case <-time.After(2 * time.Second):
+		t.Fatal("no task was queued")
+		return nil
+	}
+}
+
+func TestHandleMoveEventPairsRename(t *testing.T) {
+	taskQueue = make(chan *Task, 10)
+	defer func() { taskQueue = nil }()
+
+	root := t.TempDir()
+	watch := &Watch{ID: "test", root: root, OnRenameRun: []string{"echo"}, OnRemoveRun: []string{"echo"}}
+	config := &Config{DebounceMode: DebounceModeLeading}
+	oldPath := filepath.Join(root, "report.tmp")
+	newPath := filepath.Join(root, "report.csv")
+	if err := os.WriteFile(newPath, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The halves of a rename may arrive in either order
+	handleMoveEvent(moveEvent{notify.InMovedTo, newPath, 42}, watch, config, nil)
+	handleMoveEvent(moveEvent{notify.InMovedFrom, oldPath, 42}, watch, config, nil)
+
+	task := receiveTask(t)
+	if task.Event != RenameEvent || task.Path != newPath || task.OldPath != oldPath {
+		t.Errorf("got %s, want a rename from %s to %s", task, oldPath, newPath)
+	}
+}
+
+func TestHandleMoveEventUnpaired(t *testing.T) {
+	taskQueue = make(chan *Task, 10)
+	defer func() { taskQueue = nil }()
+
+	root := t.TempDir()
+	watch := &Watch{ID: "test", root: root, OnRemoveRun: []string{"echo"}}
+	config := &Config{DebounceMode: DebounceModeLeading}
+	gone := filepath.Join(root, "gone.csv")
+
+	start := time.Now()
+	handleMoveEvent(moveEvent{notify.InMovedFrom, gone, 7}, watch, config, nil)
+
+	task := receiveTask(t)
+	if task.Event != RemoveEvent || task.Path != gone {
+		t.Errorf("got %s, want a remove of %s", task, gone)
+	}
+	if waited := time.Since(start); waited < movePairTimeout {
+		t.Errorf("unpaired move was reported after %v, before the pairing timeout", waited)
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package main
+
+import "github.com/rjeczalik/notify"
+
+// watchedEvents are the events registered for every watch.
+var watchedEvents = []notify.Event{notify.Create, notify.Write, notify.Remove, notify.Rename}
+
+// isMoveEvent reports whether a create event is also delivered as a separate move event.
+// Only the Linux watcher does that.
+func isMoveEvent(event notify.EventInfo) bool {
+	return false
+}
+
+// handleMoveEvent handles platform-specific move events. There are none outside Linux;
+// renames arrive as notify.Rename without the old path.
+func handleMoveEvent(event notify.EventInfo, watch *Watch, config *Config, watcherChannel chan notify.EventInfo) {
+}
@@ -1,100 +1,344 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"runtime"
-	"strings"
 	"sync"
 )
 
 // setupWorkerPool creates and starts the worker pool.
-func setupWorkerPool(config *Config) (chan string, *sync.WaitGroup) {
-	if config.MaxWorkers <= 0 {
-		config.MaxWorkers = runtime.NumCPU()
-	}
+func setupWorkerPool(config *Config) (chan *Task, *sync.WaitGroup) {
+	config.MaxWorkers = poolSize(config.MaxWorkers)
 
-	taskQueue := make(chan string, 100)
+	taskQueue := make(chan *Task, 100)
 	var workerWg sync.WaitGroup
 
+	// Every worker also has a lane of its own for tasks that must run in order
+	taskLanes = make([]chan *Task, config.MaxWorkers)
 	for i := 0; i < config.MaxWorkers; i++ {
+		taskLanes[i] = make(chan *Task, 100)
 		workerWg.Add(1)
-		go worker(taskQueue, &workerWg, config, i+1)
+		go worker(taskQueue, taskLanes[i], &workerWg, config, i+1)
+	}
+
+	// Watches with their own max_workers get a dedicated pool
+	watchQueues = make(map[string]chan *Task)
+	watchLanes = make(map[string][]chan *Task)
+	workerID := config.MaxWorkers
+	for _, watch := range config.Watches {
+		if watch.MaxWorkers <= 0 {
+			continue
+		}
+		queue := make(chan *Task, 100)
+		watchQueues[watch.ID] = queue
+		logInfo("Watch %s uses a dedicated pool of %d workers", watch.ID, watch.MaxWorkers)
+		for i := 0; i < watch.MaxWorkers; i++ {
+			lane := make(chan *Task, 100)
+			watchLanes[watch.ID] = append(watchLanes[watch.ID], lane)
+			workerID++
+			workerWg.Add(1)
+			go worker(queue, lane, &workerWg, config, workerID)
+		}
 	}
 
 	return taskQueue, &workerWg
 }
 
-// worker function to process files from the task queue.
-func worker(taskQueue chan string, wg *sync.WaitGroup, config *Config, workerID int) {
-	defer wg.Done()
-	logger.Printf("Worker %d starting", workerID)
+// checkWorkerPools returns an error if newConfig needs other worker pools than the ones
+// setupWorkerPool started for config, since the pools are only built at startup.
+func checkWorkerPools(config, newConfig *Config) error {
+	if poolSize(newConfig.MaxWorkers) != poolSize(config.MaxWorkers) {
+		return fmt.Errorf("max_workers changed from %d to %d, restart required", poolSize(config.MaxWorkers), poolSize(newConfig.MaxWorkers))
+	}
+	for _, watch := range newConfig.Watches {
+		oldWorkers := 0
+		if old := findWatchByID(watch.ID, config); old != nil {
+			oldWorkers = old.MaxWorkers
+		}
+		if watch.MaxWorkers != oldWorkers {
+			return fmt.Errorf("max_workers of watch %s changed from %d to %d, restart required", watch.ID, oldWorkers, watch.MaxWorkers)
+		}
+	}
+	for _, watch := range config.Watches {
+		if watch.MaxWorkers > 0 && findWatchByID(watch.ID, newConfig) == nil {
+			return fmt.Errorf("watch %s with its own worker pool was removed, restart required", watch.ID)
+		}
+	}
+	return nil
+}
 
-	for filePathWithEvent := range taskQueue {
-		logger.Printf("Worker %d: Processing file: %s", workerID, filePathWithEvent)
+// poolSize returns the number of workers of the shared pool for a max_workers setting.
+func poolSize(maxWorkers int) int {
+	if maxWorkers <= 0 {
+		return runtime.NumCPU()
+	}
+	return maxWorkers
+}
 
-		// Parse the event type from the suffixed filePath
-		filePath, eventType := parseEventType(filePathWithEvent)
+// enqueueTask queues a task on the pool serving its watch. Partitioned tasks go to the
+// lane of their partition, so that tasks with the same key never run concurrently.
+func enqueueTask(task *Task) {
+	journal.recordEnqueue(task)
+	trackQueued(task)
+	queue, lanes := taskQueue, taskLanes
+	if watchQueue, ok := watchQueues[task.WatchID]; ok {
+		queue, lanes = watchQueue, watchLanes[task.WatchID]
+	}
+	if task.Partition != "" {
+		laneFor(task.Partition, lanes) <- task
+		return
+	}
+	queue <- task
+}
 
-		if err := processFile(filePath, config, eventType); err != nil {
-			logger.Printf("Worker %d: Error processing file %s: %v", workerID, filePath, err)
-		} else {
-			logger.Printf("Worker %d: Successfully processed file: %s", workerID, filePath)
+// closeTaskQueues closes the shared and all per-watch task queues and lanes.
+func closeTaskQueues() {
+	close(taskQueue)
+	for _, lane := range taskLanes {
+		close(lane)
+	}
+	for _, queue := range watchQueues {
+		close(queue)
+	}
+	for _, lanes := range watchLanes {
+		for _, lane := range lanes {
+			close(lane)
 		}
 	}
-
-	logger.Printf("Worker %d exiting", workerID)
 }
 
-// parseEventType extracts the file path and event type from the suffixed string.
-func parseEventType(filePathWithEvent string) (string, EventType) {
-	parts := strings.Split(filePathWithEvent, "?event=")
-	if len(parts) != 2 {
-		return filePathWithEvent, "" // Return the original string and empty event type if no suffix
+// worker function to process files from the task queue of its pool and from its own lane.
+func worker(taskQueue chan *Task, lane chan *Task, wg *sync.WaitGroup, config *Config, workerID int) {
+	defer wg.Done()
+	logInfo("Worker %d starting", workerID)
+	totalWorkers.Add(1)
+	defer totalWorkers.Add(-1)
+
+	for taskQueue != nil || lane != nil {
+		var task *Task
+		var ok bool
+		select {
+		case task, ok = <-taskQueue:
+			if !ok {
+				taskQueue = nil // Closed, keep draining the lane
+				continue
+			}
+		case task, ok = <-lane:
+			if !ok {
+				lane = nil
+				continue
+			}
+		}
+
+		// A paused pool keeps its tasks queued until it is resumed
+		waitWhileWorkersPaused()
+		ctx, ok := startWork(workerID, task)
+		if !ok {
+			logInfo("Worker %d: Skipping canceled task: %s", workerID, task)
+			journal.recordAck(task)
+			continue
+		}
+
+		task.WorkerID = workerID
+		logInfo("Worker %d: Processing file: %s", workerID, task)
+
+		err := processFile(ctx, task, config)
+		switch {
+		case errors.Is(err, errRetryScheduled):
+			// Queued again by scheduleRetry, it stays in the journal until it is done
+			finishWork(workerID)
+			continue
+		case err != nil:
+			logError("Worker %d: Error processing file %s: %v", workerID, task, err)
+			failedTasks.Add(1)
+		default:
+			logInfo("Worker %d: Successfully processed file: %s", workerID, task)
+		}
+		finishWork(workerID)
+		journal.recordAck(task)
 	}
-	return parts[0], EventType(parts[1])
+
+	logInfo("Worker %d exiting", workerID)
 }
 
-// processFile handles execution of commands and post-processing for a single file.
-func processFile(filePath string, config *Config, eventType EventType) error {
-	var cmd []string
-
-	// Select the command based on the event type
-	switch eventType {
-	case CreateEvent:
-		cmd = config.OnCreateRun
-	case RenameEvent:
-		cmd = config.OnRenameRun
-	case WriteEvent:
-		cmd = config.OnModifyRun
-	case RemoveEvent:
-		cmd = config.OnRemoveRun
-	default:
+// processFile handles execution of commands and post-processing for a single file, or
+// for every file of a batch task.
+func processFile(ctx context.Context, task *Task, config *Config) error {
+	filePath, eventType := task.Path, task.Event
+	if !isValidEventType(eventType) {
 		return fmt.Errorf("unknown event type: %s", eventType)
 	}
 
-	// Execute the command
-	if err := executeCommand(cmd, filePath); err != nil {
-		return fmt.Errorf("error executing command for file %s: %w", filePath, err)
+	// Route the file to the watch it was queued for, falling back to the watch
+	// whose root contains it if that watch was removed by a config reload
+	watch := findWatchByID(task.WatchID, config)
+	if watch == nil {
+		watch = findWatch(filePath, config)
+	}
+	if watch == nil {
+		return fmt.Errorf("no watch configured for file %s", filePath)
 	}
 
-	// Handle post-processing only if event type is not Remove
+	files := task.files()
 	if eventType != RemoveEvent {
-		return handlePostProcessing(filePath, config)
+		if files = filesToProcess(files, watch, config); len(files) == 0 {
+			return nil
+		}
+		if len(task.Batch) > 0 {
+			task.Batch = files
+			task.Path, filePath = files[0].Path, files[0].Path
+		}
+	}
+
+	// Select the commands from the matching rules, in order. Batches only hold files that
+	// match the same rules. A retried task continues with the command that failed.
+	for i, action := range selectActions(filePath, watch, eventType) {
+		if i < task.retryAction {
+			continue
+		}
+		run, accepted := task, files
+		if action.When != nil && eventType != RemoveEvent {
+			if run, accepted = whenAccepts(&action, task, files); run == nil {
+				continue
+			}
+		}
+		history, err := runAction(ctx, &action, run, watch, config)
+		task.Attempt, task.retryHistory = run.Attempt, run.retryHistory
+		var retry *retryLater
+		if errors.As(err, &retry) {
+			task.retryAction = i
+			scheduleRetry(task, retry.wait)
+			return errRetryScheduled
+		}
+		task.retryHistory = nil
+		if err != nil && ctx.Err() != nil {
+			return fmt.Errorf("task canceled while running command for file %s: %w", filePath, err)
+		}
+		if err != nil {
+			// Retries are exhausted; park the files in failed_path if configured
+			for _, file := range accepted {
+				handleFailedFile(file, watch, &action, history, err)
+			}
+			return fmt.Errorf("error executing command for file %s: %w", filePath, err)
+		}
 	}
 
-	// Handle post-processing
+	// Nothing really ran, so the files stay in place and are not recorded as processed
+	if config.DryRun {
+		logInfo("Dry run, leaving %s as it is", task)
+		return nil
+	}
+
+	var errs []error
+	for _, file := range files {
+		if err := finishFile(file, watch); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// whenAccepts checks the files of a task against the when conditions of an action. It
+// returns the task to run the action for, with a batch narrowed down to the files that
+// pass, and those files, or nil if none pass.
+func whenAccepts(action *Action, task *Task, files []*Task) (*Task, []*Task) {
+	var accepted []*Task
+	for _, file := range files {
+		if reason := action.When.rejectReason(file.Path); reason != "" {
+			logInfo("Skipping command %v for %s: %s", action.Run, file.Path, reason)
+			continue
+		}
+		accepted = append(accepted, file)
+	}
+	if len(accepted) == 0 {
+		return nil, nil
+	}
+	if len(task.Batch) == 0 || len(accepted) == len(files) {
+		return task, accepted
+	}
+
+	narrowed := *task
+	narrowed.Batch = accepted
+	narrowed.Path = accepted[0].Path
+	return &narrowed, accepted
+}
+
+// filesToProcess drops the files of a task that were processed before and have not changed
+// since, whose content a write left identical, or that don't pass the filters of the watch.
+func filesToProcess(files []*Task, watch *Watch, config *Config) []*Task {
+	var kept []*Task
+	for _, file := range files {
+		// Skip files that were processed before and have not changed since
+		if !file.Force && stateDB.isUnchanged(file.Path) {
+			logInfo("Skipping unchanged file: %s", file.Path)
+			metricSkipped.inc(watch.ID, "unchanged")
+			continue
+		}
+		if err := verifyTrigger(file.Path, watch); err != nil {
+			logError("Skipping %s: %v", file.Path, err)
+			metricSkipped.inc(watch.ID, "checksum")
+			continue
+		}
+		if config.SkipIdenticalWrites && !file.Force && isIdenticalWrite(file, config) {
+			logInfo("Skipping write to %s: content is unchanged", file.Path)
+			metricSkipped.inc(watch.ID, "identical")
+			continue
+		}
+		// The file may have changed since it was queued
+		reason, wait := watch.FileFilter.check(file.Path)
+		if wait > 0 {
+			// The worker acknowledges the task it runs, so the held file needs an ID of its own
+			held := *file
+			held.ID = newTaskID()
+			holdUntilOldEnough(&held, wait, config)
+			continue
+		}
+		if reason != "" {
+			logInfo("Skipping filtered file %s: %s", file.Path, reason)
+			metricSkipped.inc(watch.ID, "filtered")
+			continue
+		}
+		kept = append(kept, file)
+	}
+	return kept
+}
+
+// finishFile applies the post-processing of its watch to a successfully processed file and
+// then records it. A file is only remembered if it stays in place: one that post-processing
+// moved or deleted is gone from the watch, and a new file under its name must run again.
+func finishFile(task *Task, watch *Watch) error {
+	// Handle post-processing only if event type is not Remove
+	if task.Event == RemoveEvent {
+		rememberHash(task, watch)
+		stateDB.forget(task.Path)
+		return nil
+	}
+	err := handlePostProcessing(task.Path, watch)
+	observePostProcess(watch, postProcessActionName(watch.PostProcessAction), err)
+	if err != nil {
+		return err
+	}
+	rememberHash(task, watch)
+	if watch.PostProcessAction == PostProcessActionDoNothing {
+		stateDB.recordProcessed(task)
+	} else {
+		stateDB.forget(task.Path, task.OldPath)
+	}
+	cleanupTriggerFiles(task.Path, watch)
 	return nil
 }
 
 // handlePostProcessing performs actions on the file after the command has been executed.
-func handlePostProcessing(filePath string, config *Config) error {
-	switch config.PostProcessAction {
+func handlePostProcessing(filePath string, watch *Watch) error {
+	switch watch.PostProcessAction {
 	case PostProcessActionDoNothing:
-		logger.Println("File processed (no action taken):", filePath)
+		logInfo("File processed (no action taken): %s", filePath)
 	case PostProcessActionMove:
-		if err := moveFileToCompletionDir(filePath, config); err != nil {
+		if err := moveFileToCompletionDir(filePath, watch); err != nil {
 			return err
 		}
 	case PostProcessActionDelete:
@@ -102,14 +346,14 @@ func handlePostProcessing(filePath string, config *Config) error {
 			return err
 		}
 	default:
-		return fmt.Errorf("invalid post process action setting in config.yaml: %d", config.PostProcessAction)
+		return fmt.Errorf("invalid post process action setting in config.yaml: %d", watch.PostProcessAction)
 	}
 	return nil
 }
 
 // moveFileToCompletionDir moves the processed file to the completion directory.
-func moveFileToCompletionDir(filePath string, config *Config) error {
-	destPath := filepath.Join(config.ProcessedPath, filepath.Base(filePath))
+func moveFileToCompletionDir(filePath string, watch *Watch) error {
+	destPath := filepath.Join(watch.ProcessedPath, filepath.Base(filePath))
 
 	// Get the absolute path of the destination
 	absDestPath, err := filepath.Abs(destPath)
@@ -117,15 +361,15 @@ func moveFileToCompletionDir(filePath string, config *Config) error {
 		return fmt.Errorf("error getting absolute path for destination %s: %w", destPath, err)
 	}
 
-	if err := os.MkdirAll(config.ProcessedPath, 0755); err != nil {
-		return fmt.Errorf("error creating completion directory %s: %w", config.ProcessedPath, err)
+	if err := os.MkdirAll(watch.ProcessedPath, 0755); err != nil {
+		return fmt.Errorf("error creating completion directory %s: %w", watch.ProcessedPath, err)
 	}
 
 	if err := os.Rename(filePath, absDestPath); err != nil {
 		return fmt.Errorf("error moving file: %w", err)
 	}
 
-	logger.Println("Moved file to:", absDestPath) // Log the absolute destination path
+	logInfo("Moved file to: %s", absDestPath) // Log the absolute destination path
 	return nil
 }
 
@@ -134,46 +378,88 @@ func deleteFile(filePath string) error {
 	if err := os.Remove(filePath); err != nil {
 		return fmt.Errorf("error deleting file: %w", err)
 	}
-	logger.Println("Deleted file:", filePath)
+	logInfo("Deleted file: %s", filePath)
 	return nil
 }
 
-// processExistingFiles scans the watch directory and processes files that match the allowed types.
-func processExistingFiles(config *Config, taskQueue chan string) {
-	err := filepath.Walk(config.TargetPath, func(path string, info os.FileInfo, err error) error {
+// processExistingFiles scans every watch directory and processes files that match the allowed types.
+func processExistingFiles(config *Config) {
+	for i := range config.Watches {
+		processExistingWatchFiles(&config.Watches[i], config)
+	}
+}
+
+// processExistingWatchFiles scans a single watch directory and queues its existing files.
+func processExistingWatchFiles(watch *Watch, config *Config) {
+	err := filepath.Walk(watch.TargetPath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 
-		// Check if the path should be excluded
-		if isExcludedPath(path, config) {
+		// Leave paths that belong to a nested watch to that watch
+		if owner := findWatch(path, config); owner != watch {
 			if info.IsDir() {
-				logger.Printf("Skipping excluded directory: %s", path)
-				return filepath.SkipDir // Skip the entire directory
-			} else {
-				logger.Printf("Skipping excluded file: %s", path)
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// Check if the path should be excluded
+		if !info.IsDir() && (isIgnoreFile(path, watch) || isTriggerFile(path, watch)) {
+			return nil
+		}
+		if isExcludedPath(path, watch) {
+			if !info.IsDir() {
+				logInfo("Skipping excluded file: %s", path)
+				metricSkipped.inc(watch.ID, "excluded")
 				return nil
 			}
+			// With "!" patterns, files below an excluded directory may be included again
+			if !watch.excludes.canIncludeAgain() {
+				logInfo("Skipping excluded directory: %s", path)
+				return filepath.SkipDir // Skip the entire directory
+			}
 		}
 
-		if !info.IsDir() && isAllowedFileType(path, config.FileTypes) {
+		if !info.IsDir() && isIncludedFile(path, watch) {
 			// Get the absolute path
 			absPath, err := filepath.Abs(path)
 			if err != nil {
 				return fmt.Errorf("error getting absolute path for %s: %w", path, err)
 			}
 
-			logger.Println("Processing existing file:", absPath)
+			// Already queued, also from the journal, or processed before and unchanged
+			if journal.isPending(absPath) || isTaskQueued(absPath) {
+				return nil
+			}
+			if stateDB.isUnchanged(absPath) {
+				logInfo("Skipping unchanged existing file: %s", absPath)
+				return nil
+			}
+			if !triggerReady(absPath, watch) {
+				logInfo("Skipping existing file without marker or manifest: %s", absPath)
+				return nil
+			}
+			// Files younger than min_age are held once they leave debouncing
+			if reason, wait := watch.FileFilter.check(absPath); reason != "" && wait == 0 {
+				logInfo("Skipping filtered existing file %s: %s", absPath, reason)
+				metricSkipped.inc(watch.ID, "filtered")
+				return nil
+			}
+
+			logInfo("Processing existing file: %s", absPath)
 
 			// Simulate a Create event
-			if shouldProcessEvent(absPath, config) {
-				taskQueue <- absPath + "?event=create"
+			if config.DebounceMode == DebounceModeTrailing {
+				debounceTask(newTask(watch, absPath, CreateEvent), watch, config)
+			} else if shouldProcessEvent(absPath, config) {
+				dispatchTask(newTask(watch, absPath, CreateEvent), watch, config)
 			}
 		}
 		return nil
 	})
 
 	if err != nil {
-		logger.Printf("Error walking the path %s: %v", config.TargetPath, err)
+		logError("Error walking the path %s: %v", watch.TargetPath, err)
 	}
 }
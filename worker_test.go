@@ -0,0 +1,37 @@
+package main
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestCheckWorkerPools(t *testing.T) {
+	pooled := func(workers int) []Watch {
+		return []Watch{{ID: "docs", MaxWorkers: workers}}
+	}
+	current := &Config{MaxWorkers: 0, Watches: pooled(2)}
+
+	tests := []struct {
+		name      string
+		newConfig *Config
+		wantErr   string
+	}{
+		{"unchanged", &Config{Watches: pooled(2)}, ""},
+		{"default spelled out", &Config{MaxWorkers: runtime.NumCPU(), Watches: pooled(2)}, ""},
+		{"shared pool resized", &Config{MaxWorkers: runtime.NumCPU() + 1, Watches: pooled(2)}, "max_workers changed"},
+		{"watch pool resized", &Config{Watches: pooled(3)}, "max_workers of watch docs changed from 2 to 3"},
+		{"watch pool removed", &Config{}, "watch docs with its own worker pool was removed"},
+		{"new watch with a pool", &Config{Watches: append(pooled(2), Watch{ID: "new", MaxWorkers: 1})}, "max_workers of watch new changed from 0 to 1"},
+		{"new watch on the shared pool", &Config{Watches: append(pooled(2), Watch{ID: "new"})}, ""},
+	}
+	for _, tt := range tests {
+		err := checkWorkerPools(current, tt.newConfig)
+		if tt.wantErr == "" && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s: error %v, want it to mention %q", tt.name, err, tt.wantErr)
+		}
+	}
+}